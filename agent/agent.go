@@ -0,0 +1,76 @@
+// Package agent implements the guest agent protocol spoken over the vsock
+// device of every node, so the host can run commands and move files in a
+// guest without any IP networking.
+//
+// Each connection carries one request. The host sends a Request as a line of
+// JSON and the agent answers with Frames, also one JSON object per line: exec
+// streams output frames and ends with an exit frame, the other operations
+// answer with a single frame. A frame with Error set ends the exchange.
+//
+// Firecracker exposes the guest vsock as a Unix socket on the host. The host
+// connects to it, writes "CONNECT <port>\n" and reads "OK <port>\n" before
+// the connection reaches the agent listening on that port in the guest.
+package agent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultPort is the vsock port the agent listens on
+const DefaultPort = 10000
+
+// MaxFileSize bounds the files moved with OpPut and OpGet
+const MaxFileSize = 64 << 20
+
+// Operations
+const (
+	OpPing = "ping"
+	OpExec = "exec"
+	OpPut  = "put"
+	OpGet  = "get"
+)
+
+// Output streams of OpExec frames
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Request is the first and only message the host sends on a connection
+type Request struct {
+	Op      string `json:"op"`
+	Command string `json:"command,omitempty"` // OpExec; run with /bin/sh -c
+	Path    string `json:"path,omitempty"`    // OpPut and OpGet; absolute path in the guest
+	Mode    uint32 `json:"mode,omitempty"`    // OpPut; permission bits, 0644 if zero
+	Data    []byte `json:"data,omitempty"`    // OpPut
+}
+
+// Frame is a message from the agent
+type Frame struct {
+	Stream string `json:"stream,omitempty"` // Stdout or Stderr for exec output
+	Data   []byte `json:"data,omitempty"`   // exec output or OpGet contents
+	Exit   *int   `json:"exit,omitempty"`   // exit status ending OpExec, -1 if killed by a signal
+	Error  string `json:"error,omitempty"`
+}
+
+// validate checks the fields the operation needs
+func (r Request) validate() error {
+	switch r.Op {
+	case OpPing:
+	case OpExec:
+		if r.Command == "" {
+			return errors.New("exec needs a command")
+		}
+	case OpPut, OpGet:
+		if r.Path == "" || r.Path[0] != '/' {
+			return fmt.Errorf("%s needs an absolute path, got %q", r.Op, r.Path)
+		}
+		if len(r.Data) > MaxFileSize {
+			return fmt.Errorf("file is larger than %d bytes", MaxFileSize)
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client talks to the agent of one guest through the host side of its
+// Firecracker vsock device
+type Client struct {
+	udsPath string
+	port    uint32
+}
+
+// NewClient returns a client for the agent listening on port behind the
+// Firecracker vsock Unix socket at udsPath
+func NewClient(udsPath string, port uint32) *Client {
+	return &Client{udsPath: udsPath, port: port}
+}
+
+// dial connects to the agent and sends the request
+func (c *Client) dial(ctx context.Context, req Request) (net.Conn, *json.Decoder, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.udsPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to vsock %s: %w", c.udsPath, err)
+	}
+
+	// Tear the connection down when ctx is done so reads and writes return;
+	// the agent kills a running command when its connection closes
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	fail := func(err error) (net.Conn, *json.Decoder, error) {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", c.port); err != nil {
+		return fail(fmt.Errorf("failed to connect to agent port %d: %w", c.port, err))
+	}
+	// Read the handshake reply a byte at a time so nothing the agent sends
+	// after it is consumed here
+	line, err := readLine(conn)
+	if err != nil {
+		return fail(fmt.Errorf("failed to connect to agent port %d: %w", c.port, err))
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fail(fmt.Errorf("failed to connect to agent port %d: %q", c.port, line))
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fail(fmt.Errorf("failed to send %s request: %w", req.Op, err))
+	}
+	return conn, json.NewDecoder(conn), nil
+}
+
+// readLine reads up to and excluding the next newline
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 256 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("handshake reply too long")
+}
+
+// roundTrip sends a request answered by a single frame
+func (c *Client) roundTrip(ctx context.Context, req Request) (*Frame, error) {
+	conn, dec, err := c.dial(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var frame Frame
+	if err := dec.Decode(&frame); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read %s reply: %w", req.Op, err)
+	}
+	if frame.Error != "" {
+		return nil, fmt.Errorf("agent: %s", frame.Error)
+	}
+	return &frame, nil
+}
+
+// Ping checks that the agent answers
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.roundTrip(ctx, Request{Op: OpPing})
+	return err
+}
+
+// WaitReady pings the agent until it answers or ctx is done
+func (c *Client) WaitReady(ctx context.Context) error {
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := c.Ping(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("agent not ready: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Exec runs command in the guest with /bin/sh -c, copying its output to
+// stdout and stderr as it arrives, and returns its exit status. Either
+// writer may be nil to discard that stream. The command is killed when ctx
+// is done.
+func (c *Client) Exec(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	conn, dec, err := c.dial(ctx, Request{Op: OpExec, Command: command})
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	for {
+		var frame Frame
+		if err := dec.Decode(&frame); err != nil {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			return -1, fmt.Errorf("failed to read command output: %w", err)
+		}
+
+		switch {
+		case frame.Error != "":
+			return -1, fmt.Errorf("agent: %s", frame.Error)
+		case frame.Exit != nil:
+			return *frame.Exit, nil
+		case frame.Stream == Stdout && stdout != nil:
+			if _, err := stdout.Write(frame.Data); err != nil {
+				return -1, err
+			}
+		case frame.Stream == Stderr && stderr != nil:
+			if _, err := stderr.Write(frame.Data); err != nil {
+				return -1, err
+			}
+		}
+	}
+}
+
+// PutFile writes data to path in the guest with the given permissions,
+// creating the parent directories
+func (c *Client) PutFile(ctx context.Context, path string, data []byte, mode os.FileMode) error {
+	req := Request{Op: OpPut, Path: path, Mode: uint32(mode.Perm()), Data: data}
+	if err := req.validate(); err != nil {
+		return err
+	}
+	_, err := c.roundTrip(ctx, req)
+	return err
+}
+
+// GetFile reads path in the guest
+func (c *Client) GetFile(ctx context.Context, path string) ([]byte, error) {
+	frame, err := c.roundTrip(ctx, Request{Op: OpGet, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return frame.Data, nil
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// ServeConn handles the request on one connection accepted by the agent in
+// the guest and closes the connection
+func ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := &frameEncoder{enc: json.NewEncoder(conn)}
+
+	var req Request
+	if err := dec.Decode(&req); err != nil {
+		enc.error(fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		enc.error(err)
+		return
+	}
+
+	switch req.Op {
+	case OpPing:
+		enc.send(Frame{})
+	case OpExec:
+		serveExec(conn, enc, req.Command)
+	case OpPut:
+		if err := putFile(req.Path, req.Data, os.FileMode(req.Mode)); err != nil {
+			enc.error(err)
+			return
+		}
+		enc.send(Frame{})
+	case OpGet:
+		data, err := getFile(req.Path)
+		if err != nil {
+			enc.error(err)
+			return
+		}
+		enc.send(Frame{Data: data})
+	}
+}
+
+// frameEncoder serialises the frames written by the output goroutines of a
+// command
+type frameEncoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *frameEncoder) send(f Frame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(f)
+}
+
+func (e *frameEncoder) error(err error) {
+	e.send(Frame{Error: err.Error()})
+}
+
+// streamWriter turns the output of a command into frames of one stream
+type streamWriter struct {
+	enc    *frameEncoder
+	stream string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if err := w.enc.send(Frame{Stream: w.stream, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serveExec runs command and streams its output. The command is killed if
+// the host closes the connection before it exits.
+func serveExec(conn io.Reader, enc *frameEncoder, command string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nothing more is sent after the request, so a read returning means the
+	// host has gone away
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = streamWriter{enc: enc, stream: Stdout}
+	cmd.Stderr = streamWriter{enc: enc, stream: Stderr}
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		enc.error(fmt.Errorf("failed to run command: %v", err))
+		return
+	}
+
+	code := cmd.ProcessState.ExitCode()
+	enc.send(Frame{Exit: &code})
+}
+
+// putFile writes data to path through a temporary file, so readers never
+// see a partial file
+func putFile(path string, data []byte, mode os.FileMode) error {
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".agent-tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func getFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MaxFileSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", path, MaxFileSize)
+	}
+	return os.ReadFile(path)
+}
@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+
+	"firecracker-k8s/agent"
+)
+
+// guestCID is the vsock context ID of every node. Each Firecracker vsock
+// device is reached through its own host socket, so the ID only has to be
+// valid inside the guest.
+const guestCID = 3
+
+// vsockSocket is the name of the host socket of the node vsock device
+const vsockSocket = "vsock.sock"
+
+// agentUnit starts the guest agent at boot on systemd guests
+const agentUnit = `[Unit]
+Description=firecracker-k8s guest agent
+After=local-fs.target
+
+[Service]
+ExecStart=/usr/local/bin/fck8s-agent
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// vsockDevices returns the vsock device of the node and records the host
+// socket it is reached through
+func (c *Cluster) vsockDevices(node *Node) []firecracker.VsockDevice {
+	path := filepath.Join(node.RootPath, vsockSocket)
+
+	if c.Config.Jailer != nil {
+		// Firecracker creates the socket relative to the chroot
+		if jailDir, err := c.jailDir(node); err == nil {
+			node.VsockPath = filepath.Join(jailDir, "root", vsockSocket)
+		}
+		return []firecracker.VsockDevice{{ID: "agent", Path: vsockSocket, CID: guestCID}}
+	}
+
+	// Firecracker refuses to start if a previous run left the socket behind
+	os.Remove(path)
+	node.VsockPath = path
+	return []firecracker.VsockDevice{{ID: "agent", Path: path, CID: guestCID}}
+}
+
+// Agent returns a client for the guest agent of the node
+func (c *Cluster) Agent(nodeID string) (*agent.Client, error) {
+	node, err := c.Node(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if node.VsockPath == "" {
+		return nil, fmt.Errorf("node %s has no vsock device", node.ID)
+	}
+	return agent.NewClient(node.VsockPath, agent.DefaultPort), nil
+}
+
+// installAgent copies the guest agent binary into the root filesystem
+// mounted at root and enables its systemd unit
+func installAgent(binary, root string) error {
+	dst := filepath.Join(root, "usr", "local", "bin", "fck8s-agent")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(binary, dst); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, 0755); err != nil {
+		return err
+	}
+
+	unitDir := filepath.Join(root, "etc", "systemd", "system")
+	if err := os.MkdirAll(filepath.Join(unitDir, "multi-user.target.wants"), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, "fck8s-agent.service"), []byte(agentUnit), 0644); err != nil {
+		return err
+	}
+	link := filepath.Join(unitDir, "multi-user.target.wants", "fck8s-agent.service")
+	os.Remove(link)
+	return os.Symlink("/etc/systemd/system/fck8s-agent.service", link)
+}
@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// DefaultBootArgs is the kernel command line of nodes that do not set one.
+// The serial console on ttyS0 is what the console relay captures.
+const DefaultBootArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+
+// BootArgsData is what a boot arguments template is rendered with, once per
+// node. For example, to configure the guest network from the kernel command
+// line instead of the metadata service:
+//
+//	console=ttyS0 reboot=k panic=1 pci=off ip={{.IP}}::{{.Gateway}}:{{.Netmask}}:{{.Hostname}}:eth0:off
+//
+// When the rendered arguments set ip= themselves, no ip= parameter is added
+// for the node.
+type BootArgsData struct {
+	Cluster   string
+	ID        string
+	Hostname  string
+	Role      string
+	Pool      string
+	IP        string
+	Gateway   string
+	Netmask   string // dotted form of the subnet mask, IPv4 only
+	PrefixLen int
+	MAC       string
+}
+
+// launcherKernelArgs are the kernel parameters Firecracker adds for the
+// root drive, which boot arguments must leave to it
+var launcherKernelArgs = []string{"root", "ro", "rw"}
+
+// repeatableKernelArgs are the kernel parameters that may be given more
+// than once, such as console=tty0 console=ttyS0
+var repeatableKernelArgs = []string{"console"}
+
+// parseBootArgs parses a boot arguments template. BootArgsData being a
+// struct, referencing a field it does not have fails when the template is
+// executed.
+func parseBootArgs(text string) (*template.Template, error) {
+	return template.New("bootArgs").Parse(text)
+}
+
+// renderBootArgs renders a boot arguments template, folds it onto a single
+// line and checks the kernel parameters it sets
+func renderBootArgs(text string, data BootArgsData) (string, error) {
+	tmpl, err := parseBootArgs(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	args := strings.Join(strings.Fields(b.String()), " ")
+	if err := checkKernelArgs(args); err != nil {
+		return "", err
+	}
+	return args, nil
+}
+
+// checkKernelArgs rejects kernel parameters set twice and those Firecracker
+// sets itself. Arguments after -- are passed to init and not checked.
+func checkKernelArgs(args string) error {
+	seen := make(map[string]bool)
+	for _, arg := range strings.Fields(args) {
+		if arg == "--" {
+			break
+		}
+		name, _, _ := strings.Cut(arg, "=")
+		if slices.Contains(launcherKernelArgs, name) {
+			return fmt.Errorf("kernel parameter %s is set by Firecracker from the root drive", name)
+		}
+		if seen[name] && !slices.Contains(repeatableKernelArgs, name) {
+			return fmt.Errorf("kernel parameter %s is set more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// bootArgsData returns the template data of the node
+func (c *Cluster) bootArgsData(node *Node) (BootArgsData, error) {
+	_, subnet, err := net.ParseCIDR(c.Config.NetworkConfig.SubnetCIDR)
+	if err != nil {
+		return BootArgsData{}, fmt.Errorf("invalid subnet %q: %v", c.Config.NetworkConfig.SubnetCIDR, err)
+	}
+	ones, _ := subnet.Mask.Size()
+
+	data := BootArgsData{
+		Cluster:   c.Config.Name,
+		ID:        node.ID,
+		Hostname:  node.ID,
+		Role:      node.Role,
+		Pool:      node.Pool,
+		IP:        node.IP,
+		Gateway:   c.Config.NetworkConfig.Gateway,
+		PrefixLen: ones,
+		MAC:       node.MacAddress,
+	}
+	if len(subnet.Mask) == net.IPv4len {
+		data.Netmask = net.IP(subnet.Mask).String()
+	}
+	return data, nil
+}
+
+// renderNodeBootArgs replaces the boot arguments template each node got
+// from its pool with the kernel command line rendered for the node
+func (c *Cluster) renderNodeBootArgs(nodes []*Node) error {
+	for _, node := range nodes {
+		data, err := c.bootArgsData(node)
+		if err != nil {
+			return err
+		}
+		if node.BootArgs, err = renderBootArgs(node.BootArgs, data); err != nil {
+			return fmt.Errorf("failed to render boot arguments of node %s: %v", node.ID, err)
+		}
+	}
+	return nil
+}
+
+// hasKernelArg reports whether the kernel command line sets the parameter
+func hasKernelArg(args, name string) bool {
+	for _, arg := range strings.Fields(args) {
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBoot checks the kernel, initrd and boot arguments every node will
+// boot with, so a typo fails before any VM is launched
+func (cfg ClusterConfig) validateBoot(add func(field, format string, args ...interface{})) {
+	sample := BootArgsData{
+		Cluster:   cfg.Name,
+		ID:        cfg.Name + "-ms",
+		Hostname:  cfg.Name + "-ms",
+		Role:      "master",
+		Pool:      "master",
+		IP:        "172.16.0.2",
+		Gateway:   "172.16.0.1",
+		Netmask:   "255.255.255.0",
+		PrefixLen: 24,
+		MAC:       "02:fc:00:00:00:01",
+	}
+
+	// Settings inherited by several pools are reported once, under the
+	// cluster-wide field
+	checked := make(map[string]bool)
+	check := func(field string, fn func() error) {
+		if checked[field] {
+			return
+		}
+		checked[field] = true
+		if err := fn(); err != nil {
+			add(field, "%v", err)
+		}
+	}
+
+	type bootSource struct{ prefix, kernel, initrd, bootArgs string }
+	sources := []bootSource{{"", cfg.KernelPath, cfg.InitrdPath, cfg.BootArgs}}
+	if len(cfg.Pools) > 0 {
+		sources = sources[:0]
+		for i, pool := range cfg.Pools {
+			sources = append(sources, bootSource{fmt.Sprintf("pools[%d].", i), pool.KernelPath, pool.InitrdPath, pool.BootArgs})
+		}
+	}
+
+	for _, src := range sources {
+		kernelField := src.prefix + "kernelPath"
+		if src.kernel == "" {
+			kernelField, src.kernel = "kernelPath", pick(cfg.KernelPath, DefaultKernelPath)
+		}
+		check(kernelField, func() error { return checkFile(src.kernel) })
+
+		initrdField := src.prefix + "initrdPath"
+		if src.initrd == "" {
+			initrdField, src.initrd = "initrdPath", cfg.InitrdPath
+		}
+		if src.initrd != "" {
+			check(initrdField, func() error { return checkFile(src.initrd) })
+		}
+
+		bootArgsField := src.prefix + "bootArgs"
+		if src.bootArgs == "" {
+			bootArgsField, src.bootArgs = "bootArgs", pick(cfg.BootArgs, DefaultBootArgs)
+		}
+		check(bootArgsField, func() error {
+			_, err := renderBootArgs(src.bootArgs, sample)
+			return err
+		})
+	}
+}
+
+// absPath returns path made absolute, so nodes still find their kernel when
+// the cluster is started from another directory
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderBootArgs(t *testing.T) {
+	data := BootArgsData{
+		Cluster:   "dev",
+		ID:        "dev-wk-0",
+		Hostname:  "dev-wk-0",
+		IP:        "172.16.0.3",
+		Gateway:   "172.16.0.1",
+		Netmask:   "255.255.255.0",
+		PrefixLen: 24,
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "default",
+			text: DefaultBootArgs,
+			want: DefaultBootArgs,
+		},
+		{
+			name: "node fields",
+			text: "console=ttyS0 ip={{.IP}}::{{.Gateway}}:{{.Netmask}}:{{.Hostname}}:eth0:off",
+			want: "console=ttyS0 ip=172.16.0.3::172.16.0.1:255.255.255.0:dev-wk-0:eth0:off",
+		},
+		{
+			name: "folded onto one line",
+			text: "console=ttyS0\n  reboot=k\tpanic=1\n",
+			want: "console=ttyS0 reboot=k panic=1",
+		},
+		{
+			name: "repeated console",
+			text: "console=tty0 console=ttyS0",
+			want: "console=tty0 console=ttyS0",
+		},
+		{
+			name: "init arguments",
+			text: "console=ttyS0 -- rw rw",
+			want: "console=ttyS0 -- rw rw",
+		},
+		{
+			name:    "missing field",
+			text:    "console=ttyS0 hostname={{.Name}}",
+			wantErr: "can't evaluate field Name",
+		},
+		{
+			name:    "invalid template",
+			text:    "console=ttyS0 ip={{.IP",
+			wantErr: "unclosed action",
+		},
+		{
+			name:    "duplicate parameter",
+			text:    "panic=1 console=ttyS0 panic=5",
+			wantErr: "kernel parameter panic is set more than once",
+		},
+		{
+			name:    "duplicate flag",
+			text:    "pci=off quiet quiet",
+			wantErr: "kernel parameter quiet is set more than once",
+		},
+		{
+			name:    "root device",
+			text:    "console=ttyS0 root=/dev/vdb",
+			wantErr: "kernel parameter root is set by Firecracker",
+		},
+		{
+			name:    "read-only root",
+			text:    "console=ttyS0 ro",
+			wantErr: "kernel parameter ro is set by Firecracker",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderBootArgs(tt.text, data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renderBootArgs error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderBootArgs: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("renderBootArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderNodeBootArgs(t *testing.T) {
+	c := NewCluster(ClusterConfig{
+		Name:          "dev",
+		NetworkConfig: Network{SubnetCIDR: "172.16.0.0/24", Gateway: "172.16.0.1"},
+	})
+	nodes := []*Node{
+		{ID: "dev-ms", Role: "master", IP: "172.16.0.2", BootArgs: "console=ttyS0 fck8s.role={{.Role}} fck8s.net={{.IP}}/{{.PrefixLen}}"},
+		{ID: "dev-wk-0", Role: "worker", IP: "172.16.0.3", BootArgs: "console=ttyS0 fck8s.role={{.Role}} fck8s.net={{.IP}}/{{.PrefixLen}}"},
+	}
+	if err := c.renderNodeBootArgs(nodes); err != nil {
+		t.Fatalf("renderNodeBootArgs: %v", err)
+	}
+	for node, want := range map[*Node]string{
+		nodes[0]: "console=ttyS0 fck8s.role=master fck8s.net=172.16.0.2/24",
+		nodes[1]: "console=ttyS0 fck8s.role=worker fck8s.net=172.16.0.3/24",
+	} {
+		if node.BootArgs != want {
+			t.Errorf("boot arguments of %s = %q, want %q", node.ID, node.BootArgs, want)
+		}
+	}
+
+	bad := []*Node{{ID: "dev-wk-1", IP: "172.16.0.4", BootArgs: "console=ttyS0 ip={{.Address}}"}}
+	err := c.renderNodeBootArgs(bad)
+	if err == nil || !strings.Contains(err.Error(), "node dev-wk-1") {
+		t.Errorf("renderNodeBootArgs error = %v, want it to name the node", err)
+	}
+}
+
+func TestValidateBootArgs(t *testing.T) {
+	cfg := ClusterConfig{
+		Name:     "dev",
+		BootArgs: "console=ttyS0 root=/dev/vda",
+		Pools: []NodePool{
+			{Name: "master", Role: "master", Count: 1},
+			{Name: "worker", Role: "worker", Count: 2, BootArgs: "console=ttyS0 ip={{.Address}}"},
+			{Name: "gpu", Role: "worker", Count: 1, BootArgs: "console=ttyS0 hostname={{.Hostname}}"},
+		},
+	}
+
+	errs := make(map[string]string)
+	cfg.validateBoot(func(field, format string, args ...interface{}) {
+		if strings.HasSuffix(field, "bootArgs") {
+			errs[field] = format
+		}
+	})
+
+	// The cluster-wide arguments the master pool inherits are reported under
+	// the cluster-wide field
+	for _, field := range []string{"bootArgs", "pools[1].bootArgs"} {
+		if _, ok := errs[field]; !ok {
+			t.Errorf("%s not reported", field)
+		}
+	}
+	if len(errs) != 2 {
+		t.Errorf("reported %v, want bootArgs and pools[1].bootArgs only", errs)
+	}
+}
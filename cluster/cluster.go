@@ -3,15 +3,16 @@ package cluster
 import (
 	"context"
 	"fmt"
-	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
@@ -19,36 +20,89 @@ import (
 )
 
 type ClusterConfig struct {
-	Name          string
-	NodeCount     int
-	MemSizeMB     int64
-	VCPUCount     int64
-	RootDrive     string  // Path to root filesystem image
-	NetworkConfig Network // Custom network configuration
-	Persistent    bool    // Whether storage should persist after shutdown
+	Name          string           `json:"name"`
+	NodeCount     int              `json:"nodeCount,omitempty"`
+	Masters       int              `json:"masters,omitempty"` // Control plane nodes out of NodeCount when there are no pools: 1, 3 or 5; 1 by default
+	MemSizeMB     int64            `json:"memSizeMB,omitempty"`
+	VCPUCount     int64            `json:"vcpuCount,omitempty"`
+	RootDrive     string           `json:"rootDrive,omitempty"`    // Path to root filesystem image
+	DiskProvider  string           `json:"diskProvider,omitempty"` // How node root disks are made from RootDrive; auto by default
+	KernelPath    string           `json:"kernelPath,omitempty"`   // Path to uncompressed kernel image
+	InitrdPath    string           `json:"initrdPath,omitempty"`   // Optional initial ramdisk
+	BootArgs      string           `json:"bootArgs,omitempty"`     // Kernel command line template, see BootArgsData
+	SSHUser       string           `json:"sshUser,omitempty"`      // Account of the node images used over SSH; username by default
+	Pools         []NodePool       `json:"pools,omitempty"`        // Node pools; derived from NodeCount when empty
+	NetworkConfig Network          `json:"networkConfig"`          // Custom network configuration
+	Persistent    bool             `json:"persistent"`             // Whether storage should persist after shutdown
+	Jailer        *JailerConfig    `json:"jailer,omitempty"`       // Launch nodes through the jailer when set
+	AgentBinary   string           `json:"agentBinary,omitempty"`  // Guest agent installed on every node, see cmd/fck8s-agent
+	Readiness     ReadinessConfig  `json:"readiness"`              // How long nodes may take to become ready
+	Console       ConsoleConfig    `json:"console"`                // Serial console logs of the nodes
+	CNI           CNIConfig        `json:"cni"`                    // Pod network plugin
+	Kubernetes    KubernetesConfig `json:"kubernetes"`             // How kubeadm sets up Kubernetes
+	Health        HealthConfig     `json:"health"`                 // Verification once Kubernetes is set up
+	Shutdown      ShutdownConfig   `json:"shutdown"`               // How nodes are brought down
 }
 
 type Network struct {
-	SubnetCIDR string
-	Gateway    string
+	SubnetCIDR  string `json:"subnetCIDR"` // Node addresses, on the host bridge
+	Gateway     string `json:"gateway"`
+	PodCIDR     string `json:"podCIDR,omitempty"`     // Pod network of the CNI plugin; 10.244.0.0/16 by default
+	ServiceCIDR string `json:"serviceCIDR,omitempty"` // Service cluster IPs; 10.96.0.0/12 by default
+	DNSDomain   string `json:"dnsDomain,omitempty"`   // Domain of service DNS names; cluster.local by default
+	MACScheme   string `json:"macScheme,omitempty"`   // ip or hash; ip for IPv4 subnets by default
 }
 
+// Node states recorded in the cluster state file
+const (
+	NodeRunning = "running"
+	NodeStopped = "stopped"
+	NodeDead    = "dead"
+)
+
 type Node struct {
-	ID       string
-	Role     string // master or worker
-	IP       string
-	Machine  *firecracker.Machine
-	RootPath string
-	Username string
-	Password string
+	ID           string               `json:"id"`
+	Role         string               `json:"role"` // master or worker
+	Pool         string               `json:"pool"`
+	IP           string               `json:"ip"`
+	MacAddress   string               `json:"macAddress"`
+	Machine      *firecracker.Machine `json:"-"`
+	RootPath     string               `json:"rootPath"`
+	BaseImage    string               `json:"baseImage"` // Image the root disk was made from
+	RootDisk     string               `json:"rootDisk"`
+	DiskProvider string               `json:"diskProvider"`
+	VCPUCount    int64                `json:"vcpuCount"`
+	MemSizeMB    int64                `json:"memSizeMB"`
+	KernelPath   string               `json:"kernelPath"`
+	InitrdPath   string               `json:"initrdPath,omitempty"`
+	BootArgs     string               `json:"bootArgs,omitempty"` // Rendered for the node
+	SocketPath   string               `json:"socketPath"`
+	PID          int                  `json:"pid"`
+	TapName      string               `json:"tapName"`
+	UID          int                  `json:"uid,omitempty"` // User and group a jailed node runs as
+	GID          int                  `json:"gid,omitempty"`
+	ChrootDir    string               `json:"chrootDir,omitempty"`
+	VsockPath    string               `json:"vsockPath,omitempty"` // Host socket of the guest vsock device
+	Status       string               `json:"status"`              // running, stopped or dead
+	Cordoned     bool                 `json:"cordoned,omitempty"`  // Drained on stop; uncordoned on start
+	Username     string               `json:"username"`
+	Timeline     []BootEvent          `json:"timeline,omitempty"` // Readiness stages of the last boot
 }
 
 type Cluster struct {
 	Config      ClusterConfig
 	Nodes       []*Node
+	OnOutput    OutputFunc // Receives the output of node commands line by line, if set
 	ctx         context.Context
 	cancelFunc  context.CancelFunc
 	joinCommand string
+	certKey     string // Encrypts the control plane certificates uploaded for joining masters
+	lbPID       int
+	ipam        *IPAM
+	ssh         *sshPool
+	journal     *journal // Side effects on the host, see record
+	journalOnce sync.Once
+	journalErr  error
 }
 
 func NewCluster(config ClusterConfig) *Cluster {
@@ -57,39 +111,60 @@ func NewCluster(config ClusterConfig) *Cluster {
 		Config:     config,
 		ctx:        ctx,
 		cancelFunc: cancel,
+		ssh:        newSSHPool(),
 	}
 }
 
 func (c *Cluster) Provision() error {
-	// Create base working directory for the cluster
-	baseDir := filepath.Join("./firecracker-k8s-cluster", c.Config.Name)
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	c.Config.setDefaults()
+
+	// Create base working directory for the cluster. Every change made to
+	// the host from here on is journaled, so a failure can undo it.
+	baseDir := clusterDir(c.Config.Name)
+	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
+		if err := c.record(effectDir, "", baseDir, ""); err != nil {
+			return err
+		}
+	} else if err := c.record(effectFile, "", statePath(c.Config.Name), ""); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
-		return fmt.Errorf("failed to create cluster directory: %v", err)
-	}
-
-	// Initialize nodes
-	masterNode := &Node{
-		ID:       fmt.Sprintf("%s-ms", c.Config.Name),
-		Role:     "master",
-		IP:       c.Config.NetworkConfig.getNextIP("10"),
-		RootPath: filepath.Join(baseDir, "master"),
-		Username: "username",
-		Password: "password",
-	}
-
-	workers := make([]*Node, c.Config.NodeCount-1)
-	for i := range workers {
-		workers[i] = &Node{
-			ID:       fmt.Sprintf("%s-wk-%d", c.Config.Name, i),
-			Role:     "worker",
-			IP:       c.Config.NetworkConfig.getNextIP(fmt.Sprintf("%d", 20+i)),
-			RootPath: filepath.Join(baseDir, fmt.Sprintf("worker-%d", i)),
-			Username: "username",
-			Password: "password",
+		return c.abort(fmt.Errorf("failed to create cluster directory: %v", err))
+	}
+	if err := c.ensureSSHKey(); err != nil {
+		return c.abort(err)
+	}
+
+	ipam, err := OpenIPAM(c.Config.Name, c.Config.NetworkConfig)
+	if err != nil {
+		return c.abort(err)
+	}
+	c.ipam = ipam
+
+	if c.Nodes, err = c.newNodes(baseDir); err != nil {
+		return c.abort(err)
+	}
+	if err := c.assignMACs(); err != nil {
+		return c.abort(err)
+	}
+	if err := c.renderNodeBootArgs(c.Nodes); err != nil {
+		return c.abort(err)
+	}
+	if c.Config.Jailer != nil {
+		if err := c.assignJailIDs(); err != nil {
+			return c.abort(err)
 		}
 	}
+	if err := c.SaveState(); err != nil {
+		return c.abort(err)
+	}
 
-	c.Nodes = append([]*Node{masterNode}, workers...)
+	if err := c.setupHostNetwork(); err != nil {
+		return c.abort(fmt.Errorf("failed to set up host network: %v", err))
+	}
 
 	// Provision nodes in parallel
 	var wg sync.WaitGroup
@@ -108,82 +183,190 @@ func (c *Cluster) Provision() error {
 	wg.Wait()
 	close(errCh)
 
+	// Record whatever was started so a failed run can still be cleaned up
+	if err := c.SaveState(); err != nil {
+		log.Printf("Error saving state of cluster %s: %v", c.Config.Name, err)
+	}
+
 	// Check for any provisioning errors
 	for err := range errCh {
 		if err != nil {
-			c.Cleanup()
-			return err
+			return c.abort(err)
 		}
 	}
 
 	// Configure Kubernetes
 	if err := c.configureKubernetes(); err != nil {
-		c.Cleanup()
-		return fmt.Errorf("failed to configure kubernetes: %v", err)
+		return c.abort(fmt.Errorf("failed to configure kubernetes: %v", err))
+	}
+	// Cancelled after the last step that watches the context
+	if err := c.ctx.Err(); err != nil {
+		return c.abort(fmt.Errorf("provisioning cancelled: %v", err))
 	}
 
-	return nil
+	return c.SaveState()
+}
+
+// Cancel stops what the cluster is doing. A Provision in progress then
+// rolls back and returns.
+func (c *Cluster) Cancel() {
+	c.cancelFunc()
+}
+
+// abort rolls back a failed Provision and returns err, along with whatever
+// the rollback could not undo
+func (c *Cluster) abort(err error) error {
+	if rerr := c.Rollback(); rerr != nil {
+		return fmt.Errorf("%v\n%v", err, rerr)
+	}
+	return err
+}
+
+// newNodes builds the node list from the node pools, masters first, and
+// leases an address for every node
+func (c *Cluster) newNodes(baseDir string) ([]*Node, error) {
+	var masters, workers []*Node
+	for _, pool := range c.Config.Pools {
+		for i := 0; i < pool.Count; i++ {
+			node := newPoolNode(pool)
+			if pool.Role == "master" {
+				masters = append(masters, node)
+			} else {
+				workers = append(workers, node)
+			}
+		}
+	}
+
+	for i, node := range masters {
+		node.ID = fmt.Sprintf("%s-ms", c.Config.Name)
+		node.RootPath = filepath.Join(baseDir, "master")
+		if len(masters) > 1 {
+			node.ID = fmt.Sprintf("%s-ms-%d", c.Config.Name, i)
+			node.RootPath = filepath.Join(baseDir, fmt.Sprintf("master-%d", i))
+		}
+	}
+
+	for i, node := range workers {
+		node.ID = fmt.Sprintf("%s-wk-%d", c.Config.Name, i)
+		node.RootPath = filepath.Join(baseDir, fmt.Sprintf("worker-%d", i))
+	}
+
+	nodes := append(masters, workers...)
+	for _, node := range nodes {
+		if err := c.record(effectLease, node.ID, node.ID, ""); err != nil {
+			return nil, err
+		}
+		ip, err := c.ipam.Allocate(node.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate an address for node %s: %v", node.ID, err)
+		}
+		node.IP = ip.String()
+	}
+
+	return nodes, nil
+}
+
+// newPoolNode returns a node with the role and resources of the pool, yet
+// without ID, directory or address
+func newPoolNode(pool NodePool) *Node {
+	return &Node{
+		Role:       pool.Role,
+		Pool:       pool.Name,
+		BaseImage:  pool.RootDrive,
+		VCPUCount:  pool.VCPUCount,
+		MemSizeMB:  pool.MemSizeMB,
+		KernelPath: pool.KernelPath,
+		InitrdPath: pool.InitrdPath,
+		BootArgs:   pool.BootArgs,
+		Username:   pick(pool.SSHUser, DefaultSSHUser),
+	}
 }
 
 func (c *Cluster) provisionNode(node *Node) error {
 	// Create node directory
+	if err := c.record(effectDir, node.ID, node.RootPath, ""); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(node.RootPath, 0755); err != nil {
 		return err
 	}
 
-	// Copy root filesystem
-	rootDrive := filepath.Join(node.RootPath, "root.img")
-	if err := copyFile(c.Config.RootDrive, rootDrive); err != nil {
+	// Create root disk from the base image
+	if err := c.createRootDisk(node); err != nil {
 		return err
 	}
+	if err := c.prepareRootDisk(node); err != nil {
+		return err
+	}
+
+	if err := c.bootNode(node); err != nil {
+		return err
+	}
+	return c.waitReady(node, bootStages...)
+}
+
+// bootNode creates the TAP device of the node and starts its Firecracker VM
+// from the root image already present in the node directory
+func (c *Cluster) bootNode(node *Node) error {
+	return c.launchNode(node, nil)
+}
+
+// launchNode starts the Firecracker VM of the node, booting its kernel or,
+// when snap is set, loading the snapshot paused for the caller to resume
+func (c *Cluster) launchNode(node *Node, snap *NodeSnapshot) error {
+	rootDrive, err := attachRootDisk(node)
+	if err != nil {
+		return fmt.Errorf("failed to attach root disk: %v", err)
+	}
 
-	tapDevice, err := CreateTapDevice(node.ID)
+	createTap := c.createTap
+	if c.Config.Jailer != nil {
+		createTap = c.createJailedTap
+	}
+	tapDevice, err := createTap(node)
 	if err != nil {
 		return fmt.Errorf("failed to create TAP device: %v", err)
 	}
-	// var vcpuCount int64 = 1
-	// var memSizeMib int64 = 512
+	node.TapName = tapDevice
+	node.SocketPath = filepath.Join(node.RootPath, "firecracker.sock")
 	smt := true
-
-	// vmID := "vm"
-	// staticIP := "192.168.1.102"
 	driveID := "rootfs"
 	isRootDevice := true
 	isReadOnly := false
-	// pathOnHost := "./setup/ubuntu-24.04.ext4" // "./setup-microvm/root-drive-with-ssh.img"
-	// socketPath := "/tmp/firecracker-vm.sock"
-	kernelPath := "./setup/vmlinux-5.10.225"
 
-	// ifaceID := "tap0" // "eth0" // "enp2s0"
-	// tapName := "tap-" + vmID
-	// macAddress := "AA:FC:00:00:00:0" + string(vmID[len(vmID)-1])
-
-	parsedStaticIP := net.ParseIP(node.IP)
-	fmt.Println(parsedStaticIP)
+	_, subnet, err := net.ParseCIDR(c.Config.NetworkConfig.SubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", c.Config.NetworkConfig.SubnetCIDR, err)
+	}
 
 	// Configure network
 	networkInterfaces := []firecracker.NetworkInterface{{
 		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
-			HostDevName: fmt.Sprintf("tap-%s", node.ID), // tapName,
-			// MacAddress:  macAddress,
-			IPConfiguration: &firecracker.IPConfiguration{
-				IfName: tapDevice, // ifaceID,
-				IPAddr: net.IPNet{
-					IP:   net.ParseIP(node.IP), // net.IP{192, 168, 1, 100},
-					Mask: net.CIDRMask(24, 32), // "255.255.255.0"
-				},
-				Gateway: net.ParseIP(c.Config.NetworkConfig.Gateway),
-			},
+			HostDevName: tapDevice,
+			MacAddress:  node.MacAddress,
 		},
 	}}
 
+	// The kernel ip= parameter only configures IPv4; IPv6 guests configure
+	// their address themselves. Boot arguments that set ip= take precedence.
+	if ip := net.ParseIP(node.IP); ip.To4() != nil && !hasKernelArg(node.BootArgs, "ip") {
+		networkInterfaces[0].StaticConfiguration.IPConfiguration = &firecracker.IPConfiguration{
+			IfName: tapDevice, // ifaceID,
+			IPAddr: net.IPNet{
+				IP:   ip,
+				Mask: subnet.Mask,
+			},
+			Gateway: net.ParseIP(c.Config.NetworkConfig.Gateway),
+		}
+	}
+
 	// Create machine configuration
 	config := firecracker.Config{
-		SocketPath: filepath.Join(node.RootPath, "firecracker.sock"), // socketPath,
+		SocketPath: node.SocketPath, // socketPath,
 		MachineCfg: models.MachineConfiguration{
-			VcpuCount:  &c.Config.VCPUCount, // &vcpuCount,
-			MemSizeMib: &c.Config.MemSizeMB, //&memSizeMib,
-			Smt:        &smt,                // true
+			VcpuCount:  &node.VCPUCount, // &vcpuCount,
+			MemSizeMib: &node.MemSizeMB, //&memSizeMib,
+			Smt:        &smt,            // true
 		},
 		Drives: []models.Drive{
 			{
@@ -193,34 +376,111 @@ func (c *Cluster) provisionNode(node *Node) error {
 				IsReadOnly:   &isReadOnly,   // false
 			},
 		},
-		KernelImagePath:   kernelPath, // Path to kernel image
+		KernelImagePath:   node.KernelPath, // Path to kernel image
+		InitrdPath:        node.InitrdPath,
+		KernelArgs:        node.BootArgs,
 		NetworkInterfaces: networkInterfaces,
 		LogPath:           filepath.Join(node.RootPath, "firecracker.log"),
+		VsockDevices:      c.vsockDevices(node),
+	}
+
+	// Run the VMM in its own session so it outlives the command that started
+	// it and does not receive the terminal's signals
+	console, err := c.startConsole(node)
+	if err != nil {
+		return fmt.Errorf("failed to start serial console: %v", err)
+	}
+	defer console.Close()
+	node.Timeline = nil
+
+	setMetadata, err := c.configureMMDS(node, &config)
+	if err != nil {
+		return fmt.Errorf("failed to build node metadata: %v", err)
+	}
+
+	var cmd *exec.Cmd
+	if c.Config.Jailer != nil {
+		if err := c.jailMachine(node, &config); err != nil {
+			return fmt.Errorf("failed to prepare jail: %v", err)
+		}
+		if cmd, err = c.jailerCommand(c.ctx, node, config, console); err != nil {
+			return fmt.Errorf("failed to build jailer command: %v", err)
+		}
+	} else {
+		cmd = firecracker.VMCommandBuilder{}.
+			WithBin(firecrackerBinary).
+			WithSocketPath(node.SocketPath).
+			AddArgs("--id", node.ID).
+			WithStdin(console).
+			WithStdout(console).
+			WithStderr(console).
+			Build(c.ctx)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	}
+	config.ForwardSignals = []os.Signal{}
+
+	opts := []firecracker.Opt{firecracker.WithProcessRunner(cmd)}
+	if snap != nil {
+		// The vsock device is part of the snapshot and cannot be added again
+		config.VsockDevices = nil
+		opts = append(opts, firecracker.WithSnapshot(snap.memoryPath, snap.statePath))
 	}
 
 	// Create and start the machine
-	m, err := firecracker.NewMachine(c.ctx, config)
+	m, err := firecracker.NewMachine(c.ctx, config, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create machine: %v", err)
 	}
+	if c.Config.Jailer != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.LinkFilesToRootFSHandlerName, linkJailLogFile(node))
+	}
+	m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.ConfigMmdsHandlerName, setMetadata)
 
 	if err := m.Start(c.ctx); err != nil {
 		return fmt.Errorf("failed to start machine: %v", err)
 	}
+	// Loading a snapshot skips the handlers that configure the metadata
+	// service, so its contents are put back here
+	if snap != nil {
+		if err := setMetadata.Fn(c.ctx, m); err != nil {
+			log.Printf("Error restoring metadata of node %s: %v", node.ID, err)
+		}
+	}
 
 	node.Machine = m
+	node.Status = NodeRunning
+	if pid, err := m.PID(); err == nil {
+		node.PID = pid
+		if err := c.record(effectProcess, node.ID, strconv.Itoa(pid), ""); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (c *Cluster) configureKubernetes() error {
+	// An HA control plane is reached through the load balancer from the
+	// start, so every kubeconfig kubeadm writes points at it
+	if err := c.startLoadBalancer(); err != nil {
+		return err
+	}
+
 	// Initialize master node
-	master := c.Nodes[0]
-	if err := c.initializeMaster(master); err != nil {
+	masters := c.masters()
+	if err := c.initializeMaster(masters[0]); err != nil {
 		return err
 	}
 
+	// Join the other control plane nodes one at a time, as each adds an
+	// etcd member
+	for _, master := range masters[1:] {
+		if err := c.joinControlPlane(master); err != nil {
+			return err
+		}
+	}
+
 	// Join worker nodes
-	for _, worker := range c.Nodes[1:] {
+	for _, worker := range c.workers() {
 		if err := c.joinWorker(worker); err != nil {
 			return err
 		}
@@ -229,15 +489,23 @@ func (c *Cluster) configureKubernetes() error {
 	return nil
 }
 
+// Cleanup shuts the nodes down and releases what the cluster holds on the
+// host. The cluster context is only cancelled once the nodes are down, so
+// the shutdown does not run on a dead context.
 func (c *Cluster) Cleanup() {
-	c.cancelFunc()
-	for _, node := range c.Nodes {
-		if node.Machine != nil {
-			if err := node.Machine.Shutdown(c.ctx); err != nil {
-				log.Printf("Error shutting down node %s: %v", node.ID, err)
-			}
+	defer c.cancelFunc()
+
+	cfg := c.Config.Shutdown
+	cfg.Drain = false
+	report := c.shutdownNodes(c.Nodes, cfg)
+	for _, r := range report.Nodes {
+		if r.Error != "" {
+			log.Printf("Error shutting down node %s: %s", r.Node, r.Error)
 		}
+	}
+	c.ssh.closeAll()
 
+	for _, node := range c.Nodes {
 		// Clean up node directory if not persistent
 		if !c.Config.Persistent {
 			if err := os.RemoveAll(node.RootPath); err != nil {
@@ -245,13 +513,184 @@ func (c *Cluster) Cleanup() {
 			}
 		}
 	}
+
+	if err := c.stopLoadBalancer(); err != nil {
+		log.Printf("Error stopping load balancer of cluster %s: %v", c.Config.Name, err)
+	}
+	if err := c.teardownHostNetwork(); err != nil {
+		log.Printf("Error tearing down host network of cluster %s: %v", c.Config.Name, err)
+	}
+
+	// Keep the state and leases of persistent clusters so their disks can be
+	// booted again with the same addresses
+	if c.Config.Persistent {
+		if err := c.SaveState(); err != nil {
+			log.Printf("Error saving state of cluster %s: %v", c.Config.Name, err)
+		}
+		return
+	}
+	if err := c.removeState(); err != nil {
+		log.Printf("Error removing state of cluster %s: %v", c.Config.Name, err)
+	}
+	if err := releaseSubnet(c.Config.Name); err != nil {
+		log.Printf("Error releasing addresses of cluster %s: %v", c.Config.Name, err)
+	}
+	if err := os.RemoveAll(c.sshDir()); err != nil {
+		log.Printf("Error removing SSH keys of cluster %s: %v", c.Config.Name, err)
+	}
+}
+
+// Stop shuts down every node as cfg says but keeps the disks and state so
+// the cluster can be booted again with Start. Nodes that fail to shut down
+// are reported, not returned: the error is only set when the state cannot
+// be saved.
+func (c *Cluster) Stop(cfg ShutdownConfig) (*ShutdownReport, error) {
+	report := c.shutdownNodes(c.Nodes, cfg)
+	if err := c.stopLoadBalancer(); err != nil {
+		log.Printf("Error stopping load balancer of cluster %s: %v", c.Config.Name, err)
+	}
+
+	return report, c.SaveState()
+}
+
+// waitForExit waits up to timeout for the Firecracker process pid to exit,
+// as told by alive, and reports whether it did
+func waitForExit(pid int, alive func(int) bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for alive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return true
+}
+
+// Start boots every node that is not running from its existing disk, all at
+// once, with the addresses and MAC addresses it had before. Kubernetes is
+// only set up when the disks do not have it yet; otherwise the nodes rejoin
+// on their own and Start waits for them to become Ready.
+func (c *Cluster) Start() error {
+	fail := func(err error) error {
+		if saveErr := c.SaveState(); saveErr != nil {
+			log.Printf("Error saving state of cluster %s: %v", c.Config.Name, saveErr)
+		}
+		return err
+	}
+
+	// The bridge and NAT rules are gone after a cleanup or a host reboot
+	if err := c.setupHostNetwork(); err != nil {
+		return fmt.Errorf("failed to set up host network: %v", err)
+	}
+
+	// Boot the stopped nodes in parallel
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(c.Nodes))
+
+	for _, node := range c.Nodes {
+		if node.Status == NodeRunning {
+			continue
+		}
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			// A VMM that died leaves its API socket, jail and disk behind
+			if n.Status == NodeDead {
+				if r := c.shutdownNode(n, c.Config.Shutdown); r.Error != "" {
+					errCh <- fmt.Errorf("failed to clean up node %s: %s", n.ID, r.Error)
+					return
+				}
+			}
+			err := c.bootNode(n)
+			if err == nil {
+				err = c.waitReady(n, bootStages...)
+			}
+			if err != nil {
+				errCh <- fmt.Errorf("failed to start node %s: %v", n.ID, err)
+			}
+		}(node)
+	}
+
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := c.startLoadBalancer(); err != nil {
+		return fail(err)
+	}
+
+	initialized, err := c.kubernetesInitialized()
+	if err != nil {
+		return fail(err)
+	}
+	if !initialized {
+		if err := c.configureKubernetes(); err != nil {
+			return fail(fmt.Errorf("failed to configure kubernetes: %v", err))
+		}
+	} else if err := c.exportKubeconfig(c.masters()[0]); err != nil {
+		return fail(err)
+	}
+
+	if err := c.uncordonNodes(); err != nil {
+		return fail(err)
+	}
+	if err := c.waitNodesReady(); err != nil {
+		return fail(err)
+	}
+
+	return c.SaveState()
+}
+
+// Delete shuts the cluster down, undoes what provisioning did to the host
+// and removes the cluster directory, including the disks of persistent
+// clusters. If some of it cannot be undone, the state is kept so the delete
+// can be retried.
+func (c *Cluster) Delete() error {
+	if err := c.Rollback(); err != nil {
+		if serr := c.SaveState(); serr != nil {
+			log.Printf("Error saving state of cluster %s: %v", c.Config.Name, serr)
+		}
+		return err
+	}
+
+	// Clusters provisioned before the journal existed
+	c.Config.Persistent = false
+	c.Cleanup()
+	if err := os.RemoveAll(clusterDir(c.Config.Name)); err != nil {
+		return fmt.Errorf("failed to remove cluster directory: %v", err)
+	}
+	return nil
+}
+
+// Node returns the node with the given ID
+func (c *Cluster) Node(id string) (*Node, error) {
+	for _, node := range c.Nodes {
+		if node.ID == id {
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("node %s not found in cluster %s", id, c.Config.Name)
+}
+
+// Exec runs command on the node over SSH, copying its output to stdout and
+// stderr as it is written
+func (c *Cluster) Exec(nodeID, command string, stdout, stderr io.Writer) (*CommandResult, error) {
+	node, err := c.Node(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.run(c.ctx, node, command, stdout, stderr)
 }
 
 // Helper functions would be implemented here:
 // - copyFile: Copy root filesystem image
 // - initializeMaster: Initialize Kubernetes master node
 // - joinWorker: Join worker nodes to the cluster
-// - Network.getNextIP: Generate next available IP in subnet
 
 // copyFile copies a file from src to dst
 func copyFile(src, dst string) error {
@@ -283,29 +722,30 @@ func copyFile(src, dst string) error {
 
 // initializeMaster initializes the Kubernetes master node
 func (c *Cluster) initializeMaster(master *Node) error {
-	// Wait for machine to be ready
-	if err := c.waitForSSH(master); err != nil {
-		return fmt.Errorf("master node SSH not ready: %v", err)
-	}
-
-	// Initialize kubeadm
-	initCommand := fmt.Sprintf(`kubeadm init \
-		--apiserver-advertise-address=%s \
-		--pod-network-cidr=%s \
-		--node-name=%s`,
-		master.IP,
-		c.Config.NetworkConfig.SubnetCIDR,
-		master.ID,
-	)
-
-	if err := c.executeCommand(master, initCommand); err != nil {
+	if c.highlyAvailable() {
+		certKey, err := newCertificateKey()
+		if err != nil {
+			return err
+		}
+		c.certKey = certKey
+	}
+
+	if err := c.kubeadmInit(master); err != nil {
 		return fmt.Errorf("failed to initialize master: %v", err)
 	}
+	if err := c.waitReady(master, StageKubelet); err != nil {
+		return err
+	}
+
+	// Let kubectl on the host manage the cluster right away
+	if err := c.exportKubeconfig(master); err != nil {
+		return err
+	}
 
-	// Install CNI network plugin (using Calico as example)
-	calicoCommand := "kubectl apply -f https://docs.projectcalico.org/manifests/calico.yaml"
-	if err := c.executeCommand(master, calicoCommand); err != nil {
-		return fmt.Errorf("failed to install Calico: %v", err)
+	// Install the pod network from a manifest shipped with the cluster, so
+	// no internet access is needed
+	if err := c.installCNI(master); err != nil {
+		return fmt.Errorf("failed to install CNI plugin: %v", err)
 	}
 
 	// Get join command for workers
@@ -315,157 +755,48 @@ func (c *Cluster) initializeMaster(master *Node) error {
 	}
 	c.joinCommand = joinCommand
 
-	return nil
-}
-
-// joinWorker joins a worker node to the cluster
-func (c *Cluster) joinWorker(worker *Node) error {
-	// Wait for machine to be ready
-	if err := c.waitForSSH(worker); err != nil {
-		return fmt.Errorf("worker node SSH not ready: %v", err)
-	}
-
-	// Join the cluster using the stored join command
-	if err := c.executeCommand(worker, c.joinCommand); err != nil {
-		return fmt.Errorf("failed to join worker to cluster: %v", err)
+	// Let workers that bootstrap themselves from metadata join too
+	if err := c.publishJoinCommand(c.ctx); err != nil {
+		return fmt.Errorf("failed to publish join command: %v", err)
 	}
 
 	return nil
 }
 
-// getNextIP generates the next available IP in the subnet
-func (n *Network) getNextIP(host string) string {
-	// Parse the subnet CIDR
-	_, ipNet, err := net.ParseCIDR(n.SubnetCIDR)
-	if err != nil {
-		log.Printf("Error parsing CIDR: %v, using fallback IP", err)
-		return fmt.Sprintf("192.168.%s.100", host)
+// joinControlPlane joins a master node to an HA control plane, fetching the
+// certificates the first master uploaded
+func (c *Cluster) joinControlPlane(master *Node) error {
+	if err := c.kubeadmJoin(master); err != nil {
+		return fmt.Errorf("failed to join control plane node %s: %v", master.ID, err)
 	}
 
-	// Get the first three octets of the subnet
-	firstThreeOctets := strings.Join(strings.Split(ipNet.IP.String(), ".")[:3], ".")
-
-	// Return IP with provided host portion
-	return fmt.Sprintf("%s.%s", firstThreeOctets, host)
-}
-
-// waitForSSH waits for SSH to become available on the node
-func (c *Cluster) waitForSSH(node *Node) error {
-	timeout := time.After(2 * time.Minute)
-	tick := time.Tick(2 * time.Second)
-
-	for {
-		select {
-		case <-timeout:
-			return fmt.Errorf("timeout waiting for SSH on node %s", node.ID)
-		case <-tick:
-			if err := c.checkSSH(node); err == nil {
-				return nil
-			}
-		}
-	}
+	return c.waitReady(master, StageKubelet)
 }
 
-// checkSSH attempts to establish SSH connection
-func (c *Cluster) checkSSH(node *Node) error {
-	// Configure SSH client
-	config := &ssh.ClientConfig{
-		User: node.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(node.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Skip host key checking
-		Timeout:         5 * time.Second,             // Set connection timeout
-	}
-
-	// Dial SSH connection
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", node.IP), config)
-	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", node.IP, err)
-	}
-	defer conn.Close()
-
-	// Run a command
-	session, err := conn.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
-	}
-	defer session.Close()
-
-	// Run echo command
-	if err := session.Run("echo hello"); err != nil {
-		return fmt.Errorf("failed to run command: %w", err)
+// joinWorker joins a worker node to the cluster
+func (c *Cluster) joinWorker(worker *Node) error {
+	// Join the cluster with the discovery settings of the join command
+	if err := c.kubeadmJoin(worker); err != nil {
+		return fmt.Errorf("failed to join worker to cluster: %v", err)
 	}
 
-	return nil
+	return c.waitReady(worker, StageKubelet)
 }
 
 // executeCommand executes a command on the node via SSH
 func (c *Cluster) executeCommand(node *Node, command string) error {
-	// Use the SSH client from checkSSH for command execution
-	config := &ssh.ClientConfig{
-		User: node.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(node.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Skip host key checking
-		Timeout:         5 * time.Second,             // Set connection timeout
-	}
-
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", node.IP), config)
-	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", node.IP, err)
-	}
-	defer conn.Close()
-
-	session, err := conn.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed to create SSH session: %w", err)
-	}
-	defer session.Close()
-
-	// Execute the command
-	if err := session.Run(command); err != nil {
-		return fmt.Errorf("failed to execute command on %s: %w", node.ID, err)
-	}
-
-	return nil
+	_, err := c.run(c.ctx, node, command, nil, nil)
+	return err
 }
 
-// getJoinCommand retrieves the kubeadm join command from the master
+// getJoinCommand creates a join token on the master and returns the kubeadm
+// join command using it. The token is described as joinTokenDescription.
 func (c *Cluster) getJoinCommand(master *Node) (string, error) {
-	cmd := exec.Command("ssh", "-p", "password",
-		"-o", "StrictHostKeyChecking=no",
-		fmt.Sprintf("root@%s", master.IP),
-		"kubeadm token create --print-join-command")
-
-	output, err := cmd.Output()
+	command := "kubeadm token create --print-join-command --description " + shellQuote(joinTokenDescription)
+	result, err := c.run(c.ctx, master, command, nil, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to get join command: %v", err)
 	}
 
-	return strings.TrimSpace(string(output)), nil
-}
-
-func CreateTapDevice(vmID string) (string, error) {
-	tapName := fmt.Sprintf("tap-%s", vmID)
-
-	checkCmd := exec.Command("ip", "link", "show", tapName)
-	if err := checkCmd.Run(); err == nil {
-		log.Printf("TAP device %s already exists, skipping creation.", tapName)
-		return tapName, nil
-	}
-
-	createCmd := exec.Command("ip", "tuntap", "add", "dev", tapName, "mode", "tap")
-	if output, err := createCmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("failed to create TAP device %s: %v\nOutput: %s", tapName, err, string(output))
-	}
-
-	upCmd := exec.Command("ip", "link", "set", "dev", tapName, "up")
-	if output, err := upCmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("failed to bring up TAP device %s: %v\nOutput: %s", tapName, err, string(output))
-	}
-
-	log.Printf("TAP device %s created and brought up successfully.", tapName)
-	return tapName, nil
+	return strings.TrimSpace(result.Stdout), nil
 }
@@ -0,0 +1,245 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"sigs.k8s.io/yaml"
+)
+
+// CNI plugins
+const (
+	CNICalico  = "calico"
+	CNICilium  = "cilium"
+	CNIFlannel = "flannel"
+	CNINone    = "none" // no plugin is installed; nodes stay NotReady until one is
+)
+
+// DefaultPodCIDR is the pod network of clusters that do not set one
+const DefaultPodCIDR = "10.244.0.0/16"
+
+// cniManifestPath is where the manifest is copied on the master before it
+// is applied
+const cniManifestPath = "/etc/firecracker-k8s/cni.yaml"
+
+// adminKubeconfig is the kubeconfig kubeadm writes on control plane nodes
+const adminKubeconfig = "/etc/kubernetes/admin.conf"
+
+//go:embed cni/flannel.yaml
+var flannelManifest []byte
+
+// embeddedCNIManifests are the manifests installed when no local manifest
+// is given, so clusters come up without internet access. Only flannel is
+// embedded: calico needs its release manifest (calico.yaml) and cilium the
+// output of helm template or cilium install --dry-run, with the
+// configuration the pod CIDR is patched into.
+var embeddedCNIManifests = map[string][]byte{
+	CNIFlannel: flannelManifest,
+}
+
+// CNIConfig selects the pod network plugin
+type CNIConfig struct {
+	Plugin   string `json:"plugin,omitempty"`   // calico, cilium, flannel or none; flannel by default
+	Manifest string `json:"manifest,omitempty"` // Local manifest to install instead of the embedded one; required for calico and cilium
+}
+
+// validate checks the CNI settings and reports problems through add
+func (cc CNIConfig) validate(add func(field, format string, args ...interface{})) {
+	plugin := pick(cc.Plugin, CNIFlannel)
+	switch plugin {
+	case CNICalico, CNICilium, CNIFlannel:
+	case CNINone:
+		if cc.Manifest != "" {
+			add("cni.manifest", "must not be set when plugin is %q", CNINone)
+		}
+		return
+	default:
+		add("cni.plugin", "must be %q, %q, %q or %q, got %q", CNICalico, CNICilium, CNIFlannel, CNINone, cc.Plugin)
+		return
+	}
+
+	if cc.Manifest == "" {
+		if _, ok := embeddedCNIManifests[plugin]; !ok {
+			add("cni.manifest", "is required for %s, which has no embedded manifest", plugin)
+		}
+		return
+	}
+	if err := checkFile(cc.Manifest); err != nil {
+		add("cni.manifest", "%v", err)
+		return
+	}
+
+	// Catch manifests that do not install the plugin, such as a bare
+	// NetworkPolicy, before any node boots
+	data, err := os.ReadFile(cc.Manifest)
+	if err != nil {
+		add("cni.manifest", "%v", err)
+		return
+	}
+	if _, err := patchCNIManifest(plugin, data, DefaultPodCIDR); err != nil {
+		add("cni.manifest", "%s does not install %s: %v", cc.Manifest, plugin, err)
+	}
+}
+
+// cniManifest returns the manifest of the configured plugin with the pod
+// CIDR of the cluster patched in
+func (c *Cluster) cniManifest() ([]byte, error) {
+	plugin := pick(c.Config.CNI.Plugin, CNIFlannel)
+	manifest := embeddedCNIManifests[plugin]
+	if c.Config.CNI.Manifest != "" {
+		data, err := os.ReadFile(c.Config.CNI.Manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CNI manifest: %v", err)
+		}
+		manifest = data
+	}
+	return patchCNIManifest(plugin, manifest, c.podCIDR())
+}
+
+// podCIDR returns the pod network of the cluster
+func (c *Cluster) podCIDR() string {
+	return pick(c.Config.NetworkConfig.PodCIDR, DefaultPodCIDR)
+}
+
+// installCNI copies the pod network manifest to the master and applies it
+func (c *Cluster) installCNI(master *Node) error {
+	if pick(c.Config.CNI.Plugin, CNIFlannel) == CNINone {
+		return nil
+	}
+
+	manifest, err := c.cniManifest()
+	if err != nil {
+		return err
+	}
+	if err := c.putFile(c.ctx, master, cniManifestPath, manifest, 0644); err != nil {
+		return fmt.Errorf("failed to copy CNI manifest to %s: %v", master.ID, err)
+	}
+	return c.kubectl(c.ctx, master, "apply -f "+cniManifestPath)
+}
+
+// kubectl runs kubectl on a master with the admin kubeconfig
+func (c *Cluster) kubectl(ctx context.Context, master *Node, args string) error {
+	_, err := c.run(ctx, master, fmt.Sprintf("kubectl --kubeconfig=%s %s", adminKubeconfig, args), nil, nil)
+	return err
+}
+
+// documentSeparator splits a multi-document YAML stream
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// patchCNIManifest sets the pod CIDR where the plugin reads it from:
+// the net-conf.json of the flannel ConfigMap, the CALICO_IPV4POOL_CIDR of
+// the calico-node DaemonSet or the cluster pool of the cilium ConfigMap.
+// Documents that are not patched are kept as they are.
+func patchCNIManifest(plugin string, manifest []byte, podCIDR string) ([]byte, error) {
+	docs := documentSeparator.Split(string(manifest), -1)
+	patched := false
+	for i, doc := range docs {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, fmt.Errorf("invalid CNI manifest document %d: %v", i+1, err)
+		}
+		if obj == nil {
+			continue
+		}
+
+		kind, _ := obj["kind"].(string)
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+
+		var ok bool
+		var err error
+		switch {
+		case plugin == CNIFlannel && kind == "ConfigMap" && name == "kube-flannel-cfg":
+			ok, err = patchFlannelConfig(obj, podCIDR)
+		case plugin == CNICalico && kind == "DaemonSet" && name == "calico-node":
+			ok = patchCalicoNode(obj, podCIDR)
+		case plugin == CNICilium && kind == "ConfigMap" && name == "cilium-config":
+			ok = patchCiliumConfig(obj, podCIDR)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = "\n" + string(out)
+		patched = true
+	}
+
+	if !patched {
+		return nil, fmt.Errorf("CNI manifest has no %s configuration to set the pod CIDR in", plugin)
+	}
+
+	var b bytes.Buffer
+	for i, doc := range docs {
+		if i > 0 {
+			b.WriteString("---")
+		}
+		b.WriteString(doc)
+	}
+	return b.Bytes(), nil
+}
+
+func patchFlannelConfig(obj map[string]interface{}, podCIDR string) (bool, error) {
+	data, _ := obj["data"].(map[string]interface{})
+	netConf, _ := data["net-conf.json"].(string)
+	if netConf == "" {
+		return false, nil
+	}
+
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(netConf), &conf); err != nil {
+		return false, fmt.Errorf("invalid flannel net-conf.json: %v", err)
+	}
+	conf["Network"] = podCIDR
+	out, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	data["net-conf.json"] = string(out) + "\n"
+	return true, nil
+}
+
+func patchCalicoNode(obj map[string]interface{}, podCIDR string) bool {
+	spec, _ := obj["spec"].(map[string]interface{})
+	template, _ := spec["template"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+	containers, _ := podSpec["containers"].([]interface{})
+
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+		if container["name"] != "calico-node" {
+			continue
+		}
+		env, _ := container["env"].([]interface{})
+		var kept []interface{}
+		for _, e := range env {
+			if v, _ := e.(map[string]interface{}); v["name"] != "CALICO_IPV4POOL_CIDR" {
+				kept = append(kept, e)
+			}
+		}
+		container["env"] = append(kept, map[string]interface{}{"name": "CALICO_IPV4POOL_CIDR", "value": podCIDR})
+		return true
+	}
+	return false
+}
+
+func patchCiliumConfig(obj map[string]interface{}, podCIDR string) bool {
+	data, _ := obj["data"].(map[string]interface{})
+	if data == nil {
+		data = make(map[string]interface{})
+		obj["data"] = data
+	}
+	data["cluster-pool-ipv4-cidr"] = podCIDR
+	return true
+}
@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+// findDocument returns the object of the given kind and name in a
+// multi-document manifest
+func findDocument(t *testing.T, manifest []byte, kind, name string) map[string]interface{} {
+	t.Helper()
+	for _, doc := range documentSeparator.Split(string(manifest), -1) {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			t.Fatalf("patched manifest is invalid: %v", err)
+		}
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if obj["kind"] == kind && metadata["name"] == name {
+			return obj
+		}
+	}
+	t.Fatalf("%s %s not found in patched manifest", kind, name)
+	return nil
+}
+
+const calicoNodeManifest = `apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: calico-node
+spec:
+  template:
+    spec:
+      containers:
+      - name: calico-node
+        env:
+        - name: DATASTORE_TYPE
+          value: kubernetes
+        - name: CALICO_IPV4POOL_CIDR
+          value: 192.168.0.0/16
+`
+
+const networkPolicyManifest = `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: default-deny
+spec:
+  podSelector: {}
+`
+
+func TestPatchCNIManifest(t *testing.T) {
+	podCIDR := "10.50.0.0/16"
+
+	tests := []struct {
+		name     string
+		plugin   string
+		manifest string
+		check    func(t *testing.T, out []byte)
+		wantErr  string
+	}{
+		{
+			name:     "flannel net-conf",
+			plugin:   CNIFlannel,
+			manifest: string(flannelManifest),
+			check: func(t *testing.T, out []byte) {
+				cm := findDocument(t, out, "ConfigMap", "kube-flannel-cfg")
+				data := cm["data"].(map[string]interface{})
+				var conf map[string]interface{}
+				if err := json.Unmarshal([]byte(data["net-conf.json"].(string)), &conf); err != nil {
+					t.Fatalf("net-conf.json is invalid: %v", err)
+				}
+				if conf["Network"] != podCIDR {
+					t.Errorf("Network = %v, want %s", conf["Network"], podCIDR)
+				}
+				backend, _ := conf["Backend"].(map[string]interface{})
+				if backend["Type"] != "vxlan" {
+					t.Errorf("Backend = %v, want it kept", conf["Backend"])
+				}
+				// The other documents are left alone
+				findDocument(t, out, "DaemonSet", "kube-flannel-ds")
+			},
+		},
+		{
+			name:     "flannel with invalid net-conf",
+			plugin:   CNIFlannel,
+			manifest: "kind: ConfigMap\nmetadata:\n  name: kube-flannel-cfg\ndata:\n  net-conf.json: '{'\n",
+			wantErr:  "invalid flannel net-conf.json",
+		},
+		{
+			name:     "calico replaces CALICO_IPV4POOL_CIDR",
+			plugin:   CNICalico,
+			manifest: calicoNodeManifest,
+			check: func(t *testing.T, out []byte) {
+				ds := findDocument(t, out, "DaemonSet", "calico-node")
+				container := ds["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+				var cidrs []interface{}
+				var others int
+				for _, e := range container["env"].([]interface{}) {
+					v := e.(map[string]interface{})
+					if v["name"] == "CALICO_IPV4POOL_CIDR" {
+						cidrs = append(cidrs, v["value"])
+					} else {
+						others++
+					}
+				}
+				if len(cidrs) != 1 || cidrs[0] != podCIDR {
+					t.Errorf("CALICO_IPV4POOL_CIDR = %v, want only %s", cidrs, podCIDR)
+				}
+				if others != 1 {
+					t.Errorf("kept %d other variables, want 1", others)
+				}
+			},
+		},
+		{
+			name:     "cilium config without data",
+			plugin:   CNICilium,
+			manifest: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cilium-config\n",
+			check: func(t *testing.T, out []byte) {
+				cm := findDocument(t, out, "ConfigMap", "cilium-config")
+				data, _ := cm["data"].(map[string]interface{})
+				if data["cluster-pool-ipv4-cidr"] != podCIDR {
+					t.Errorf("cluster-pool-ipv4-cidr = %v, want %s", data["cluster-pool-ipv4-cidr"], podCIDR)
+				}
+			},
+		},
+		{
+			name:     "bare NetworkPolicy",
+			plugin:   CNICilium,
+			manifest: networkPolicyManifest,
+			wantErr:  "no cilium configuration to set the pod CIDR in",
+		},
+		{
+			name:     "manifest of another plugin",
+			plugin:   CNICalico,
+			manifest: string(flannelManifest),
+			wantErr:  "no calico configuration to set the pod CIDR in",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := patchCNIManifest(tt.plugin, []byte(tt.manifest), podCIDR)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("patchCNIManifest error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("patchCNIManifest: %v", err)
+			}
+			tt.check(t, out)
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DefaultKernelPath is the kernel booted by nodes that do not set one
+const DefaultKernelPath = "./setup/vmlinux-5.10.225"
+
+// DefaultSSHUser is the account of the node images that nodes are reached
+// as over SSH when neither their pool nor the cluster sets one
+const DefaultSSHUser = "username"
+
+// maxTapNameLen is the longest interface name the kernel accepts (IFNAMSIZ - 1)
+const maxTapNameLen = 15
+
+var clusterNameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// interfaceTagRe matches the names interfaceTag returns. A cluster named like
+// one would get the bridge of the cluster the tag stands for.
+var interfaceTagRe = regexp.MustCompile(`^[0-9a-f]{6}$`)
+
+// userNameRe matches the user names useradd accepts by default
+var userNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// NodePool is a group of nodes sharing a role and resources. Zero values are
+// inherited from the cluster-wide settings in ClusterConfig.
+type NodePool struct {
+	Name       string `json:"name"`
+	Role       string `json:"role"` // master or worker
+	Count      int    `json:"count"`
+	VCPUCount  int64  `json:"vcpuCount,omitempty"`
+	MemSizeMB  int64  `json:"memSizeMB,omitempty"`
+	RootDrive  string `json:"rootDrive,omitempty"`
+	KernelPath string `json:"kernelPath,omitempty"`
+	InitrdPath string `json:"initrdPath,omitempty"`
+	BootArgs   string `json:"bootArgs,omitempty"` // Template, see BootArgsData
+	SSHUser    string `json:"sshUser,omitempty"`
+}
+
+// FieldError describes an invalid value in a cluster configuration
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError lists every problem found in a cluster configuration
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return "invalid cluster configuration:\n  " + strings.Join(msgs, "\n  ")
+}
+
+// withPrefix returns a copy of the errors with prefix prepended to each field
+func (e ValidationError) withPrefix(prefix string) ValidationError {
+	out := make(ValidationError, len(e))
+	for i, fe := range e {
+		out[i] = FieldError{Field: prefix + fe.Field, Message: fe.Message}
+	}
+	return out
+}
+
+// Validate checks the configuration and reports every invalid field, using
+// the field names of the spec file format
+func (cfg ClusterConfig) Validate() error {
+	var errs ValidationError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !clusterNameRe.MatchString(cfg.Name) {
+		add("name", "must consist of lowercase letters, digits and '-', got %q", cfg.Name)
+	} else if interfaceTagRe.MatchString(cfg.Name) {
+		add("name", "must not be 6 hexadecimal digits, which stand for clusters in interface names, got %q", cfg.Name)
+	}
+
+	nodeCount := cfg.NodeCount
+	if len(cfg.Pools) == 0 {
+		if cfg.NodeCount < 1 {
+			add("nodeCount", "must be at least 1, got %d", cfg.NodeCount)
+		}
+		if masters := pick(cfg.Masters, 1); !validMasterCount(masters) {
+			add("masters", "must be 1, 3 or 5, got %d", masters)
+		} else if cfg.NodeCount < masters {
+			add("nodeCount", "must be at least the %d masters, got %d", masters, cfg.NodeCount)
+		}
+		if cfg.VCPUCount < 1 {
+			add("vcpuCount", "must be at least 1, got %d", cfg.VCPUCount)
+		}
+		if cfg.MemSizeMB < 128 {
+			add("memSizeMB", "must be at least 128, got %d", cfg.MemSizeMB)
+		}
+		if cfg.RootDrive == "" {
+			add("rootDrive", "is required")
+		} else if err := checkFile(cfg.RootDrive); err != nil {
+			add("rootDrive", "%v", err)
+		}
+	} else {
+		nodeCount = 0
+		masters := 0
+		names := make(map[string]bool)
+		for i, pool := range cfg.Pools {
+			field := fmt.Sprintf("pools[%d]", i)
+			if pool.Name == "" {
+				add(field+".name", "is required")
+			} else if names[pool.Name] {
+				add(field+".name", "duplicate pool name %q", pool.Name)
+			}
+			names[pool.Name] = true
+
+			switch pool.Role {
+			case "master":
+				masters += pool.Count
+			case "worker":
+			default:
+				add(field+".role", "must be master or worker, got %q", pool.Role)
+			}
+			if pool.Count < 1 {
+				add(field+".count", "must be at least 1, got %d", pool.Count)
+			}
+			nodeCount += pool.Count
+
+			if v := pick(pool.VCPUCount, cfg.VCPUCount); v < 1 {
+				add(field+".vcpuCount", "must be at least 1 (set it on the pool or cluster-wide), got %d", v)
+			}
+			if v := pick(pool.MemSizeMB, cfg.MemSizeMB); v < 128 {
+				add(field+".memSizeMB", "must be at least 128 (set it on the pool or cluster-wide), got %d", v)
+			}
+			if pool.SSHUser != "" && !userNameRe.MatchString(pool.SSHUser) {
+				add(field+".sshUser", "invalid user name %q", pool.SSHUser)
+			}
+			if v := pick(pool.RootDrive, cfg.RootDrive); v == "" {
+				add(field+".rootDrive", "is required (set it on the pool or cluster-wide)")
+			} else if err := checkFile(v); err != nil {
+				add(field+".rootDrive", "%v", err)
+			}
+		}
+		if masters == 0 {
+			add("pools", "at least one pool with role master is required")
+		} else if !validMasterCount(masters) {
+			add("pools", "master pools must have 1, 3 or 5 nodes in total, got %d", masters)
+		}
+		if cfg.Masters != 0 {
+			add("masters", "only applies without pools; set the count of the master pools instead")
+		}
+	}
+
+	if _, ok := diskProviders[cfg.DiskProvider]; !ok && cfg.DiskProvider != "" && cfg.DiskProvider != DiskAuto {
+		add("diskProvider", "must be one of %q, %q, %q, %q or %q, got %q",
+			DiskAuto, DiskReflink, DiskSparse, DiskCopy, DiskDMSnapshot, cfg.DiskProvider)
+	}
+
+	cfg.validateBoot(add)
+
+	if cfg.SSHUser != "" && !userNameRe.MatchString(cfg.SSHUser) {
+		add("sshUser", "invalid user name %q", cfg.SSHUser)
+	}
+	if cfg.AgentBinary != "" {
+		if err := checkFile(cfg.AgentBinary); err != nil {
+			add("agentBinary", "%v", err)
+		}
+	}
+
+	if cfg.Jailer != nil {
+		cfg.Jailer.validate(cfg, add)
+	}
+	cfg.Readiness.validate(add)
+	cfg.Console.validate(add)
+	cfg.CNI.validate(add)
+	cfg.Kubernetes.validate(add)
+	cfg.Health.validate(add)
+	cfg.Shutdown.validate(add)
+
+	// The longest TAP device name belongs to the last worker
+	if tap := nodeTapName(cfg.Name, fmt.Sprintf("%s-wk-%d", cfg.Name, nodeCount)); len(tap) > maxTapNameLen {
+		add("nodeCount", "too many nodes: TAP device %q exceeds %d characters", tap, maxTapNameLen)
+	}
+
+	_, subnet, err := net.ParseCIDR(cfg.NetworkConfig.SubnetCIDR)
+	if err != nil {
+		add("networkConfig.subnetCIDR", "invalid CIDR %q", cfg.NetworkConfig.SubnetCIDR)
+	} else if n := usableAddresses(subnet, nodeCount); n < nodeCount {
+		add("networkConfig.subnetCIDR", "%s has room for %d nodes, %d requested", subnet, n, nodeCount)
+	}
+	switch cfg.NetworkConfig.MACScheme {
+	case "", MACFromHash:
+	case MACFromIP:
+		if subnet != nil && subnet.IP.To4() == nil {
+			add("networkConfig.macScheme", "%q needs an IPv4 subnet", MACFromIP)
+		}
+	default:
+		add("networkConfig.macScheme", "must be %q or %q, got %q", MACFromIP, MACFromHash, cfg.NetworkConfig.MACScheme)
+	}
+
+	gateway := net.ParseIP(cfg.NetworkConfig.Gateway)
+	if gateway == nil {
+		add("networkConfig.gateway", "invalid IP address %q", cfg.NetworkConfig.Gateway)
+	} else if subnet != nil && !subnet.Contains(gateway) {
+		add("networkConfig.gateway", "%s is not inside subnet %s", gateway, subnet)
+	}
+	cfg.validateNetworks(add)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// TotalNodes returns the number of nodes the configuration asks for: the
+// sum of the pool counts, or NodeCount when there are no pools
+func (cfg ClusterConfig) TotalNodes() int {
+	if len(cfg.Pools) == 0 {
+		return cfg.NodeCount
+	}
+	n := 0
+	for _, pool := range cfg.Pools {
+		n += pool.Count
+	}
+	return n
+}
+
+// setDefaults fills in the boot and jailer settings, making the kernel and
+// initrd paths absolute, and, for configurations without node pools, derives
+// one master pool and one worker pool from NodeCount and Masters
+func (cfg *ClusterConfig) setDefaults() {
+	cfg.KernelPath = absPath(pick(cfg.KernelPath, DefaultKernelPath))
+	cfg.InitrdPath = absPath(cfg.InitrdPath)
+	cfg.BootArgs = pick(cfg.BootArgs, DefaultBootArgs)
+	if cfg.Jailer != nil {
+		cfg.Jailer.setDefaults()
+	}
+
+	if len(cfg.Pools) == 0 {
+		masters := pick(cfg.Masters, 1)
+		cfg.Pools = []NodePool{{Name: "master", Role: "master", Count: masters}}
+		if cfg.NodeCount > masters {
+			cfg.Pools = append(cfg.Pools, NodePool{Name: "worker", Role: "worker", Count: cfg.NodeCount - masters})
+		}
+		cfg.Masters = 0
+	}
+
+	cfg.NodeCount = 0
+	for i := range cfg.Pools {
+		pool := &cfg.Pools[i]
+		pool.VCPUCount = pick(pool.VCPUCount, cfg.VCPUCount)
+		pool.MemSizeMB = pick(pool.MemSizeMB, cfg.MemSizeMB)
+		pool.RootDrive = pick(pool.RootDrive, cfg.RootDrive)
+		pool.KernelPath = absPath(pick(pool.KernelPath, cfg.KernelPath))
+		pool.InitrdPath = absPath(pick(pool.InitrdPath, cfg.InitrdPath))
+		pool.BootArgs = pick(pool.BootArgs, cfg.BootArgs)
+		pool.SSHUser = pick(pool.SSHUser, pick(cfg.SSHUser, DefaultSSHUser))
+		cfg.NodeCount += pool.Count
+	}
+}
+
+// validMasterCount reports whether a control plane of n nodes keeps etcd
+// quorum when one of them fails, or is a single master
+func validMasterCount(n int) bool {
+	return n == 1 || n == 3 || n == 5
+}
+
+// pick returns v unless it is the zero value, in which case it returns def
+func pick[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
+
+// checkFile returns an error unless path names an existing regular file
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file %q does not exist", path)
+		}
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%q is a directory", path)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"firecracker-k8s/console"
+)
+
+// ConsoleRelayCommand is the hidden subcommand of the running executable
+// that relays the serial console of a node, see console.Serve. The program
+// embedding this package must dispatch it to RunConsoleRelay.
+const ConsoleRelayCommand = "console-relay"
+
+// Files of the serial console in the node directory
+const (
+	consoleLogFile = "console.log"
+	consoleSocket  = "console.sock"
+)
+
+// ConsoleConfig controls how the serial console of every node is kept. Zero
+// values take the defaults of the console package.
+type ConsoleConfig struct {
+	LogSizeMB int64 `json:"logSizeMB,omitempty"` // size at which the console log is rotated; 10 by default
+	LogFiles  int   `json:"logFiles,omitempty"`  // rotated console logs kept; 3 by default
+	BufferKB  int   `json:"bufferKB,omitempty"`  // recent output kept in memory for status and attach; 64 by default
+}
+
+// validate checks the console settings and reports problems through add
+func (cc ConsoleConfig) validate(add func(field, format string, args ...interface{})) {
+	if cc.LogSizeMB < 0 {
+		add("console.logSizeMB", "must not be negative, got %d", cc.LogSizeMB)
+	}
+	if cc.LogFiles < 0 {
+		add("console.logFiles", "must not be negative, got %d", cc.LogFiles)
+	}
+	if cc.BufferKB < 0 {
+		add("console.bufferKB", "must not be negative, got %d", cc.BufferKB)
+	}
+}
+
+func consoleSocketPath(node *Node) string {
+	return filepath.Join(node.RootPath, consoleSocket)
+}
+
+// startConsole opens the pseudo-terminal of the node serial console and
+// starts the relay process keeping its output. It returns the terminal side
+// the VMM runs on, which the caller closes once the VMM has started.
+func (c *Cluster) startConsole(node *Node) (*os.File, error) {
+	master, slave, err := console.OpenPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer master.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		slave.Close()
+		return nil, fmt.Errorf("failed to find console relay executable: %v", err)
+	}
+
+	// The relay runs in its own session, like the VMM, so it outlives the
+	// command that started it
+	cfg := c.Config.Console
+	cmd := exec.Command(self, ConsoleRelayCommand,
+		"-log", filepath.Join(node.RootPath, consoleLogFile),
+		"-socket", consoleSocketPath(node),
+		"-log-size", strconv.FormatInt(pick(cfg.LogSizeMB<<20, int64(console.DefaultLogSize)), 10),
+		"-log-files", strconv.Itoa(pick(cfg.LogFiles, console.DefaultLogFiles)),
+		"-buffer", strconv.Itoa(pick(cfg.BufferKB<<10, console.DefaultBufferSize)),
+	)
+	cmd.ExtraFiles = []*os.File{master}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	os.Remove(consoleSocketPath(node))
+	if err := cmd.Start(); err != nil {
+		slave.Close()
+		return nil, fmt.Errorf("failed to start console relay: %v", err)
+	}
+	go cmd.Wait()
+
+	// Wait for the relay socket so the output of the whole boot is captured
+	// and readiness probes can reach it
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := os.Stat(consoleSocketPath(node)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			slave.Close()
+			return nil, fmt.Errorf("console relay of node %s did not start", node.ID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return slave, nil
+}
+
+// RunConsoleRelay runs the console relay of a node, as started by
+// startConsole with the terminal master as its first extra file
+func RunConsoleRelay(cfg console.RelayConfig) error {
+	master := os.NewFile(3, "ptmx")
+	if master == nil {
+		return fmt.Errorf("no console terminal passed to the relay")
+	}
+	return console.Serve(master, cfg)
+}
+
+// ConsoleTail returns the last lines the node printed on its serial console.
+// They come from the relay of a running node and from the console log of a
+// stopped one.
+func (c *Cluster) ConsoleTail(ctx context.Context, nodeID string, lines int) ([]string, error) {
+	node, err := c.Node(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := console.Tail(ctx, consoleSocketPath(node))
+	if err != nil {
+		if data, err = readTail(filepath.Join(node.RootPath, consoleLogFile), int64(console.DefaultBufferSize)); err != nil {
+			return nil, err
+		}
+	}
+	return lastLines(data, lines), nil
+}
+
+// AttachConsole connects in and out to the serial console of a running node
+// until in reaches EOF or ctx is done
+func (c *Cluster) AttachConsole(ctx context.Context, nodeID string, in io.Reader, out io.Writer) error {
+	node, err := c.Node(nodeID)
+	if err != nil {
+		return err
+	}
+	if node.Status != NodeRunning {
+		return fmt.Errorf("node %s is not running", node.ID)
+	}
+	return console.Attach(ctx, consoleSocketPath(node), in, out)
+}
+
+// readTail returns at most the last n bytes of the file
+func readTail(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > n {
+		if _, err := f.Seek(-n, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(f)
+}
+
+// lastLines splits console output into lines, without carriage returns,
+// and returns the last n of them
+func lastLines(data []byte, n int) []string {
+	data = bytes.ReplaceAll(data, []byte("\r"), nil)
+	text := strings.TrimRight(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
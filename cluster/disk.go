@@ -0,0 +1,397 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Root disk providers
+const (
+	// DiskAuto clones with DiskReflink and falls back to DiskSparse when
+	// the filesystem cannot share extents
+	DiskAuto = "auto"
+
+	// DiskReflink shares the extents of the base image (FICLONE), so the
+	// clone is instant and only blocks the node writes take space. Needs
+	// btrfs, or xfs with reflink enabled.
+	DiskReflink = "reflink"
+
+	// DiskSparse copies only the data regions of the base image, found with
+	// SEEK_DATA/SEEK_HOLE, and leaves holes unallocated
+	DiskSparse = "sparse"
+
+	// DiskCopy copies the whole base image
+	DiskCopy = "copy"
+
+	// DiskDMSnapshot exposes a device-mapper snapshot of the base image
+	// with a sparse per-node copy-on-write file. Needs losetup and dmsetup.
+	DiskDMSnapshot = "dm-snapshot"
+)
+
+// DiskProvider creates and exposes the root disk of a node
+type DiskProvider interface {
+	// Create makes a new writable disk at dst backed by base
+	Create(base, dst string) error
+
+	// Attach returns the path the VM opens for the disk at dst, setting up
+	// any device it needs
+	Attach(base, dst string) (string, error)
+
+	// Detach releases what Attach set up. The disk itself is kept.
+	Detach(dst string) error
+}
+
+var diskProviders = map[string]DiskProvider{
+	DiskReflink:    reflinkDisk{},
+	DiskSparse:     sparseDisk{},
+	DiskCopy:       copyDisk{},
+	DiskDMSnapshot: dmSnapshotDisk{},
+}
+
+// errReflinkUnsupported is returned when the filesystem cannot clone extents
+var errReflinkUnsupported = errors.New("filesystem does not support reflinks")
+
+// createRootDisk creates the root disk of the node with the cluster's disk
+// provider and records the provider actually used
+func (c *Cluster) createRootDisk(node *Node) error {
+	name := pick(c.Config.DiskProvider, DiskAuto)
+
+	disk := filepath.Join(node.RootPath, "root.img")
+	if name == DiskDMSnapshot {
+		disk = filepath.Join(node.RootPath, "root.cow")
+	}
+	if err := c.record(effectDisk, node.ID, disk, name); err != nil {
+		return err
+	}
+
+	if name == DiskAuto {
+		err := reflinkDisk{}.Create(node.BaseImage, disk)
+		if err == nil {
+			name = DiskReflink
+		} else if errors.Is(err, errReflinkUnsupported) {
+			name = DiskSparse
+			err = sparseDisk{}.Create(node.BaseImage, disk)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		provider, ok := diskProviders[name]
+		if !ok {
+			return fmt.Errorf("unknown disk provider %q", name)
+		}
+		if err := provider.Create(node.BaseImage, disk); err != nil {
+			return err
+		}
+	}
+
+	node.DiskProvider = name
+	node.RootDisk = disk
+	return nil
+}
+
+// attachRootDisk returns the path the VM of the node opens as its root drive
+func attachRootDisk(node *Node) (string, error) {
+	// Nodes recorded before disk providers existed have a plain copy
+	if node.DiskProvider == "" {
+		return filepath.Join(node.RootPath, "root.img"), nil
+	}
+
+	provider, ok := diskProviders[node.DiskProvider]
+	if !ok {
+		return "", fmt.Errorf("unknown disk provider %q", node.DiskProvider)
+	}
+	return provider.Attach(node.BaseImage, node.RootDisk)
+}
+
+// rootDiskFile returns the file holding what the node wrote to its root
+// disk: the disk itself, or the copy-on-write file of a dm-snapshot disk
+func rootDiskFile(node *Node) string {
+	if node.RootDisk == "" {
+		return filepath.Join(node.RootPath, "root.img")
+	}
+	return node.RootDisk
+}
+
+// cloneDisk copies the disk file src to dst, sharing extents when the
+// filesystem can and leaving holes otherwise
+func cloneDisk(src, dst string) error {
+	err := reflinkDisk{}.Create(src, dst)
+	if errors.Is(err, errReflinkUnsupported) {
+		err = sparseCopy(src, dst)
+	}
+	return err
+}
+
+// freezeRootDisk makes rootDiskFile consistent with what the node wrote
+// until thaw is called. Only dm-snapshot disks keep state outside the file.
+func freezeRootDisk(node *Node) (thaw func() error, err error) {
+	if node.DiskProvider != DiskDMSnapshot {
+		return func() error { return nil }, nil
+	}
+	d := dmSnapshotDisk{}
+	if err := d.suspend(node.RootDisk); err != nil {
+		return nil, err
+	}
+	return func() error { return d.resume(node.RootDisk) }, nil
+}
+
+// detachRootDisk releases the devices backing the root disk of the node
+func detachRootDisk(node *Node) error {
+	provider, ok := diskProviders[node.DiskProvider]
+	if !ok {
+		return nil
+	}
+	return provider.Detach(node.RootDisk)
+}
+
+// prepareRootDisk mounts the root disk of the node and installs what the
+// node needs before its first boot: the cluster SSH key and, if configured,
+// the guest agent. The node must not boot unless the disk was unmounted,
+// since the guest would otherwise see a filesystem still in use.
+func (c *Cluster) prepareRootDisk(node *Node) (err error) {
+	device, err := attachRootDisk(node)
+	if err != nil {
+		return fmt.Errorf("failed to attach root disk: %v", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if derr := detachRootDisk(node); derr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to detach root disk: %v", derr))
+		}
+	}()
+
+	mnt, err := os.MkdirTemp("", "fck8s-root-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+
+	if _, err := runTool("mount", device, mnt); err != nil {
+		return err
+	}
+	defer func() {
+		if _, uerr := runTool("umount", mnt); uerr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to unmount root disk: %v", uerr))
+		}
+	}()
+
+	if err := c.installSSHKey(node, mnt); err != nil {
+		return fmt.Errorf("failed to install SSH key: %v", err)
+	}
+	if c.Config.AgentBinary != "" {
+		if err := installAgent(c.Config.AgentBinary, mnt); err != nil {
+			return fmt.Errorf("failed to install guest agent: %v", err)
+		}
+	}
+	return nil
+}
+
+// fileDisk is embedded by the providers whose disk is a plain file
+type fileDisk struct{}
+
+func (fileDisk) Attach(base, dst string) (string, error) {
+	return dst, nil
+}
+
+func (fileDisk) Detach(dst string) error {
+	return nil
+}
+
+type copyDisk struct{ fileDisk }
+
+func (copyDisk) Create(base, dst string) error {
+	return copyFile(base, dst)
+}
+
+type reflinkDisk struct{ fileDisk }
+
+func (reflinkDisk) Create(base, dst string) error {
+	src, err := os.Open(base)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %v", err)
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(src.Fd())); err != nil {
+		os.Remove(dst)
+		switch {
+		case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOTTY),
+			errors.Is(err, unix.EXDEV), errors.Is(err, unix.EINVAL):
+			return fmt.Errorf("failed to clone %s: %w", base, errReflinkUnsupported)
+		}
+		return fmt.Errorf("failed to clone %s: %v", base, err)
+	}
+
+	return nil
+}
+
+type sparseDisk struct{ fileDisk }
+
+func (sparseDisk) Create(base, dst string) error {
+	return sparseCopy(base, dst)
+}
+
+// sparseCopy copies the data regions of src to dst, leaving holes in dst
+// wherever src has them
+func sparseCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %v", err)
+	}
+	defer out.Close()
+
+	if err := out.Truncate(size); err != nil {
+		return fmt.Errorf("failed to size destination file: %v", err)
+	}
+
+	fd := int(in.Fd())
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // only a hole is left
+		}
+		if errors.Is(err, unix.EINVAL) {
+			// No SEEK_DATA support, treat the rest as data
+			start = offset
+		} else if err != nil {
+			return fmt.Errorf("failed to find data in %s: %v", src, err)
+		}
+
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			end = size
+		}
+
+		if _, err := io.Copy(io.NewOffsetWriter(out, start), io.NewSectionReader(in, start, end-start)); err != nil {
+			return fmt.Errorf("failed to copy file: %v", err)
+		}
+		offset = end
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %v", err)
+	}
+	return nil
+}
+
+type dmSnapshotDisk struct{}
+
+// Create makes an empty sparse copy-on-write file the size of the base image
+func (dmSnapshotDisk) Create(base, dst string) error {
+	info, err := os.Stat(base)
+	if err != nil {
+		return fmt.Errorf("failed to stat base image: %v", err)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create copy-on-write file: %v", err)
+	}
+	defer f.Close()
+
+	return f.Truncate(info.Size())
+}
+
+// Attach sets up loop devices for the base image and the copy-on-write file
+// and a snapshot device on top of them
+func (d dmSnapshotDisk) Attach(base, dst string) (string, error) {
+	name := d.deviceName(dst)
+	device := filepath.Join("/dev/mapper", name)
+	if _, err := os.Stat(device); err == nil {
+		return device, nil
+	}
+
+	info, err := os.Stat(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat base image: %v", err)
+	}
+
+	baseLoop, err := runTool("losetup", "--find", "--show", "--read-only", base)
+	if err != nil {
+		return "", err
+	}
+	cowLoop, err := runTool("losetup", "--find", "--show", dst)
+	if err != nil {
+		runTool("losetup", "--detach", baseLoop)
+		return "", err
+	}
+
+	// Persistent snapshot with 4KiB chunks
+	table := fmt.Sprintf("0 %d snapshot %s %s P 8", info.Size()/512, baseLoop, cowLoop)
+	if _, err := runTool("dmsetup", "create", name, "--table", table); err != nil {
+		runTool("losetup", "--detach", cowLoop)
+		runTool("losetup", "--detach", baseLoop)
+		return "", err
+	}
+
+	// Detaching busy loop devices marks them for autoclear, so they go away
+	// together with the snapshot device
+	runTool("losetup", "--detach", cowLoop)
+	runTool("losetup", "--detach", baseLoop)
+
+	return device, nil
+}
+
+func (d dmSnapshotDisk) Detach(dst string) error {
+	name := d.deviceName(dst)
+	if _, err := os.Stat(filepath.Join("/dev/mapper", name)); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := runTool("dmsetup", "remove", name)
+	return err
+}
+
+// suspend flushes the device and commits the exception metadata to the
+// copy-on-write file, holding further I/O until resume
+func (d dmSnapshotDisk) suspend(dst string) error {
+	_, err := runTool("dmsetup", "suspend", d.deviceName(dst))
+	return err
+}
+
+func (d dmSnapshotDisk) resume(dst string) error {
+	_, err := runTool("dmsetup", "resume", d.deviceName(dst))
+	return err
+}
+
+// deviceName derives the device-mapper name from the node directory
+func (dmSnapshotDisk) deviceName(dst string) string {
+	rel := strings.TrimPrefix(filepath.Clean(filepath.Dir(dst)), filepath.Clean(BaseDir)+string(filepath.Separator))
+	return "fck8s-" + strings.ReplaceAll(rel, string(filepath.Separator), "-")
+}
+
+// runTool runs an external tool and returns its trimmed output
+func runTool(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v\nOutput: %s", name, strings.Join(args, " "), err, string(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocatedBytes returns the disk space allocated to the file
+func allocatedBytes(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseCopy(t *testing.T) {
+	const (
+		mib  = 1 << 20
+		size = 16 * mib
+	)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "base.img")
+
+	// Holes around a data region in the middle and data at the very end,
+	// where the copy must not stop at the last hole
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	middle := bytes.Repeat([]byte("middle"), 4096/6)
+	last := bytes.Repeat([]byte("end"), 4096/3)
+	for _, w := range []struct {
+		data   []byte
+		offset int64
+	}{
+		{middle, 4 * mib},
+		{last, size - int64(len(last))},
+	} {
+		if _, err := f.WriteAt(w.data, w.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if allocatedBytes(t, src) >= size/2 {
+		t.Skip("the filesystem of the temporary directory does not keep holes")
+	}
+
+	dst := filepath.Join(dir, "root.img")
+	if err := sparseCopy(src, dst); err != nil {
+		t.Fatalf("sparseCopy: %v", err)
+	}
+
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != size {
+		t.Fatalf("copy is %d bytes, want %d", len(got), size)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("copy differs from the source")
+	}
+
+	// The copy may round the data regions to other block boundaries, but
+	// must not fill the holes
+	if srcAlloc, dstAlloc := allocatedBytes(t, src), allocatedBytes(t, dst); dstAlloc > srcAlloc+mib {
+		t.Errorf("copy allocates %d bytes, source %d", dstAlloc, srcAlloc)
+	}
+}
+
+func TestSparseCopyOfHole(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "empty.img")
+	if err := os.WriteFile(src, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(src, 8<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "root.img")
+	if err := sparseCopy(src, dst); err != nil {
+		t.Fatalf("sparseCopy: %v", err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 8<<20 {
+		t.Errorf("copy is %d bytes, want %d", info.Size(), 8<<20)
+	}
+	if alloc := allocatedBytes(t, dst); alloc > allocatedBytes(t, src) {
+		t.Errorf("copy of a hole allocates %d bytes", alloc)
+	}
+}
+
+func TestDMSnapshotDeviceName(t *testing.T) {
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		{filepath.Join(clusterDir("dev"), "master", "root.cow"), "fck8s-dev-master"},
+		{filepath.Join(clusterDir("dev"), "worker-12", "root.cow"), "fck8s-dev-worker-12"},
+		{filepath.Join(clusterDir("staging-eu"), "master-2", "root.cow"), "fck8s-staging-eu-master-2"},
+		{"firecracker-k8s-cluster/dev/worker-0/root.cow", "fck8s-dev-worker-0"},
+	}
+	for _, tt := range tests {
+		if got := (dmSnapshotDisk{}).deviceName(tt.dst); got != tt.want {
+			t.Errorf("deviceName(%s) = %s, want %s", tt.dst, got, tt.want)
+		}
+	}
+
+	// Nodes of different clusters get different devices
+	a := (dmSnapshotDisk{}).deviceName(filepath.Join(clusterDir("a"), "worker-0", "root.cow"))
+	b := (dmSnapshotDisk{}).deviceName(filepath.Join(clusterDir("b"), "worker-0", "root.cow"))
+	if a == b {
+		t.Errorf("worker-0 of clusters a and b share device %s", a)
+	}
+}
@@ -0,0 +1,336 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Health checks, in the order they run once Kubernetes is set up
+const (
+	CheckNodes   = "nodes"   // every node is registered and Ready
+	CheckCoreDNS = "coredns" // the CoreDNS pods are running and ready
+	CheckCNI     = "cni"     // a pod of the CNI plugin is running and ready on every node
+	CheckDNS     = "dns"     // a pod resolves the kubernetes service through the cluster DNS
+)
+
+// healthChecks lists the checks in order
+var healthChecks = []string{CheckNodes, CheckCoreDNS, CheckCNI, CheckDNS}
+
+// DefaultSmokeTestImage runs the DNS smoke test pod; it needs nslookup
+const DefaultSmokeTestImage = "busybox:1.36"
+
+// defaultHealthTimeout bounds each health check
+const defaultHealthTimeout = 5 * time.Minute
+
+// cniPodSelectors are the labels of the per-node pods of each plugin
+var cniPodSelectors = map[string]string{
+	CNICalico:  "k8s-app=calico-node",
+	CNICilium:  "k8s-app=cilium",
+	CNIFlannel: "app=flannel",
+}
+
+// HealthConfig controls the verification of a cluster once it is set up.
+// Zero values take the defaults.
+type HealthConfig struct {
+	Timeout        Duration `json:"timeout,omitempty"`        // per check; 5m by default
+	SmokeTestImage string   `json:"smokeTestImage,omitempty"` // image of the DNS smoke test pod; busybox by default
+	Skip           []string `json:"skip,omitempty"`           // checks not run, e.g. dns when no image can be pulled
+}
+
+func (hc HealthConfig) skipped(check string) bool {
+	for _, s := range hc.Skip {
+		if s == check {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the health settings and reports problems through add
+func (hc HealthConfig) validate(add func(field, format string, args ...interface{})) {
+	if hc.Timeout < 0 {
+		add("health.timeout", "must not be negative, got %s", time.Duration(hc.Timeout))
+	}
+	for i, check := range hc.Skip {
+		known := false
+		for _, c := range healthChecks {
+			known = known || c == check
+		}
+		if !known {
+			add(fmt.Sprintf("health.skip[%d]", i), "unknown check %q", check)
+		}
+	}
+}
+
+// CheckResult is the outcome of one health check
+type CheckResult struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Message  string        `json:"message"` // what was found, or why the check failed
+}
+
+// HealthReport lists the outcome of every health check
+type HealthReport struct {
+	Checks []CheckResult `json:"checks"`
+}
+
+// Healthy reports whether every check that ran passed
+func (r *HealthReport) Healthy() bool {
+	for _, check := range r.Checks {
+		if !check.Passed && !check.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// kubeClient returns a client for the API server, using the kubeconfig
+// exported to the host
+func (c *Cluster) kubeClient() (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", c.KubeconfigPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	config.Timeout = 10 * time.Second
+	return kubernetes.NewForConfig(config)
+}
+
+// VerifyHealth runs the health checks against the API server, each until it
+// passes or its timeout expires. Failed checks are reported, not returned:
+// the error is only set when the checks could not run at all.
+func (c *Cluster) VerifyHealth(ctx context.Context) (*HealthReport, error) {
+	client, err := c.kubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	interval := pick(time.Duration(c.Config.Readiness.Interval), time.Second)
+	timeout := pick(time.Duration(c.Config.Health.Timeout), defaultHealthTimeout)
+
+	report := &HealthReport{}
+	for _, name := range healthChecks {
+		result := CheckResult{Name: name}
+		if c.Config.Health.skipped(name) {
+			result.Skipped = true
+			result.Message = "skipped"
+			report.Checks = append(report.Checks, result)
+			continue
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err := c.runHealthCheck(checkCtx, client, name, interval, &result)
+		cancel()
+		result.Duration = time.Since(start)
+		result.Passed = err == nil
+		if err != nil {
+			result.Message = err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+	}
+	return report, nil
+}
+
+// runHealthCheck runs one check until it passes or ctx is done, leaving
+// what it found in the message of the result
+func (c *Cluster) runHealthCheck(ctx context.Context, client kubernetes.Interface, name string, interval time.Duration, result *CheckResult) error {
+	probe := func(fn func(context.Context) (string, error)) error {
+		return poll(ctx, interval, func(ctx context.Context) error {
+			msg, err := fn(ctx)
+			result.Message = msg
+			return err
+		})
+	}
+
+	switch name {
+	case CheckNodes:
+		return probe(func(ctx context.Context) (string, error) {
+			return c.checkNodes(ctx, client)
+		})
+
+	case CheckCoreDNS:
+		return probe(func(ctx context.Context) (string, error) {
+			return checkPods(ctx, client, metav1.NamespaceSystem, "k8s-app=kube-dns", 1)
+		})
+
+	case CheckCNI:
+		plugin := pick(c.Config.CNI.Plugin, CNIFlannel)
+		if plugin == CNINone {
+			result.Skipped = true
+			result.Message = "no CNI plugin installed"
+			return nil
+		}
+		// Plugins installed from a custom manifest may use another namespace
+		return probe(func(ctx context.Context) (string, error) {
+			return checkPods(ctx, client, metav1.NamespaceAll, cniPodSelectors[plugin], len(c.Nodes))
+		})
+
+	case CheckDNS:
+		return c.checkDNS(ctx, client, interval, result)
+
+	default:
+		return fmt.Errorf("unknown health check %q", name)
+	}
+}
+
+// checkNodes checks that every node of the cluster is registered and Ready
+func (c *Cluster) checkNodes(ctx context.Context, client kubernetes.Interface) (string, error) {
+	list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	ready := make(map[string]bool)
+	for _, node := range list.Items {
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == corev1.NodeReady && cond.Status == corev1.ConditionTrue {
+				ready[node.Name] = true
+			}
+		}
+	}
+
+	var notReady []string
+	for _, node := range c.Nodes {
+		if !ready[node.ID] {
+			notReady = append(notReady, node.ID)
+		}
+	}
+	msg := fmt.Sprintf("%d/%d nodes ready", len(c.Nodes)-len(notReady), len(c.Nodes))
+	if len(notReady) > 0 {
+		return msg, fmt.Errorf("%s, waiting for %s", msg, strings.Join(notReady, ", "))
+	}
+	return msg, nil
+}
+
+// waitNodesReady waits until every node of the cluster is registered and
+// Ready, for as long as a health check may take
+func (c *Cluster) waitNodesReady() error {
+	client, err := c.kubeClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, pick(time.Duration(c.Config.Health.Timeout), defaultHealthTimeout))
+	defer cancel()
+	interval := pick(time.Duration(c.Config.Readiness.Interval), time.Second)
+	err = poll(ctx, interval, func(ctx context.Context) error {
+		_, err := c.checkNodes(ctx, client)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("nodes of cluster %s not ready: %v", c.Config.Name, err)
+	}
+	return nil
+}
+
+// checkPods checks that at least min pods match the selector and that all of
+// them are running with every container ready
+func checkPods(ctx context.Context, client kubernetes.Interface, namespace, selector string, min int) (string, error) {
+	list, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", err
+	}
+
+	var pending []string
+	for _, pod := range list.Items {
+		if reason := podNotReady(&pod); reason != "" {
+			pending = append(pending, fmt.Sprintf("%s (%s)", pod.Name, reason))
+		}
+	}
+	running := len(list.Items) - len(pending)
+	msg := fmt.Sprintf("%d/%d pods %s running", running, max(len(list.Items), min), selector)
+	switch {
+	case len(pending) > 0:
+		return msg, fmt.Errorf("%s, waiting for %s", msg, strings.Join(pending, ", "))
+	case len(list.Items) < min:
+		return msg, fmt.Errorf("%s, waiting for %d more", msg, min-len(list.Items))
+	}
+	return msg, nil
+}
+
+// podNotReady returns why the pod is not running with every container
+// ready, or "" if it is
+func podNotReady(pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Waiting != nil && cs.State.Waiting.Reason != "" {
+			return cs.State.Waiting.Reason
+		}
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return string(pod.Status.Phase)
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if !cs.Ready {
+			return cs.Name + " not ready"
+		}
+	}
+	return ""
+}
+
+// checkDNS runs a pod resolving the kubernetes service through the cluster
+// DNS and waits for it to succeed. The pod retries failed lookups itself and
+// is deleted whatever the outcome.
+func (c *Cluster) checkDNS(ctx context.Context, client kubernetes.Interface, interval time.Duration, result *CheckResult) error {
+	name := "kubernetes.default.svc." + c.dnsDomain()
+	pods := client.CoreV1().Pods(metav1.NamespaceDefault)
+
+	pod, err := pods.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "fck8s-dns-check-",
+			Labels:       map[string]string{"app.kubernetes.io/managed-by": "firecracker-k8s"},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyOnFailure,
+			Containers: []corev1.Container{{
+				Name:    "nslookup",
+				Image:   pick(c.Config.Health.SmokeTestImage, DefaultSmokeTestImage),
+				Command: []string{"nslookup", name},
+			}},
+			// Single node clusters only have a control plane node
+			Tolerations: []corev1.Toleration{{
+				Key:      "node-role.kubernetes.io/control-plane",
+				Operator: corev1.TolerationOpExists,
+				Effect:   corev1.TaintEffectNoSchedule,
+			}},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create DNS check pod: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	}()
+
+	return poll(ctx, interval, func(ctx context.Context) error {
+		p, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if p.Status.Phase == corev1.PodSucceeded {
+			result.Message = fmt.Sprintf("%s resolved from pod %s", name, p.Name)
+			return nil
+		}
+
+		err = fmt.Errorf("pod %s cannot resolve %s yet (%s)", p.Name, name, pick(podNotReady(p), string(p.Status.Phase)))
+		if logs, lerr := pods.GetLogs(p.Name, &corev1.PodLogOptions{}).DoRaw(ctx); lerr == nil && len(logs) > 0 {
+			lines := strings.Split(strings.TrimSpace(string(logs)), "\n")
+			err = fmt.Errorf("%v: %s", err, lines[len(lines)-1])
+		}
+		return err
+	})
+}
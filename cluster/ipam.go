@@ -0,0 +1,310 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const (
+	leasesFileName = "leases.json"
+	ipamLockName   = ".ipam.lock"
+)
+
+// IPAM hands out node addresses from the subnet of a cluster. Leases are
+// kept in the cluster directory so they survive restarts, and the network,
+// gateway and (for IPv4) broadcast addresses are never handed out. A subnet
+// may not overlap the subnet of any other cluster on the host.
+type IPAM struct {
+	mu      sync.Mutex
+	cluster string
+	subnet  *net.IPNet
+	gateway net.IP
+	leases  map[string]string // IP -> owner
+}
+
+// leaseFile is the on-disk representation of the leases of a cluster
+type leaseFile struct {
+	Subnet  string            `json:"subnet"`
+	Gateway string            `json:"gateway"`
+	Leases  map[string]string `json:"leases"`
+}
+
+// OpenIPAM claims the subnet of network for the named cluster and loads the
+// leases it already holds. It fails if the subnet overlaps a subnet claimed
+// by another cluster.
+func OpenIPAM(clusterName string, network Network) (*IPAM, error) {
+	_, subnet, err := net.ParseCIDR(network.SubnetCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %v", network.SubnetCIDR, err)
+	}
+	gateway := net.ParseIP(network.Gateway)
+	if gateway == nil || !subnet.Contains(gateway) {
+		return nil, fmt.Errorf("gateway %q is not inside subnet %s", network.Gateway, subnet)
+	}
+
+	a := &IPAM{
+		cluster: clusterName,
+		subnet:  subnet,
+		gateway: normalizeIP(gateway),
+		leases:  make(map[string]string),
+	}
+
+	err = withIPAMLock(func() error {
+		if err := checkSubnetOverlap(clusterName, subnet); err != nil {
+			return err
+		}
+
+		existing, err := readLeases(clusterName)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.Subnet != subnet.String() && len(existing.Leases) > 0 {
+			return fmt.Errorf("cluster %s still holds leases in subnet %s", clusterName, existing.Subnet)
+		}
+		if existing != nil && existing.Subnet == subnet.String() {
+			for ip, owner := range existing.Leases {
+				a.leases[ip] = owner
+			}
+		}
+
+		return a.save()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Allocate leases the next free address to owner. An owner that already
+// holds a lease gets the same address back.
+func (a *IPAM) Allocate(owner string) (net.IP, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for ip, o := range a.leases {
+		if o == owner {
+			return net.ParseIP(ip), nil
+		}
+	}
+
+	var ip net.IP
+	err := withIPAMLock(func() error {
+		for candidate := nextIP(a.subnet.IP); a.subnet.Contains(candidate); candidate = nextIP(candidate) {
+			if a.reserved(candidate) {
+				continue
+			}
+			if _, taken := a.leases[candidate.String()]; !taken {
+				ip = candidate
+				break
+			}
+		}
+		if ip == nil {
+			return fmt.Errorf("subnet %s has no free addresses", a.subnet)
+		}
+
+		a.leases[ip.String()] = owner
+		return a.save()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ip, nil
+}
+
+// Release returns the address leased to owner to the pool
+func (a *IPAM) Release(owner string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return withIPAMLock(func() error {
+		for ip, o := range a.leases {
+			if o == owner {
+				delete(a.leases, ip)
+			}
+		}
+		return a.save()
+	})
+}
+
+// Mask returns the netmask of the subnet
+func (a *IPAM) Mask() net.IPMask {
+	return a.subnet.Mask
+}
+
+// reserved reports whether ip may never be leased
+func (a *IPAM) reserved(ip net.IP) bool {
+	if ip.Equal(a.gateway) || ip.Equal(a.subnet.IP) {
+		return true
+	}
+	// IPv4 subnets reserve their last address for broadcast
+	if ip.To4() != nil {
+		return ip.Equal(lastIP(a.subnet))
+	}
+	return false
+}
+
+// save writes the leases to the cluster directory. Callers hold the IPAM lock.
+func (a *IPAM) save() error {
+	data, err := json.MarshalIndent(leaseFile{
+		Subnet:  a.subnet.String(),
+		Gateway: a.gateway.String(),
+		Leases:  a.leases,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(clusterDir(a.cluster), 0755); err != nil {
+		return fmt.Errorf("failed to create cluster directory: %v", err)
+	}
+
+	path := filepath.Join(clusterDir(a.cluster), leasesFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write leases: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// releaseSubnet drops every lease of the named cluster and its claim on the
+// subnet
+func releaseSubnet(clusterName string) error {
+	return withIPAMLock(func() error {
+		err := os.Remove(filepath.Join(clusterDir(clusterName), leasesFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// readLeases returns the lease file of the named cluster, or nil if it has none
+func readLeases(clusterName string) (*leaseFile, error) {
+	data, err := os.ReadFile(filepath.Join(clusterDir(clusterName), leasesFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read leases of cluster %s: %v", clusterName, err)
+	}
+
+	var lf leaseFile
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return nil, fmt.Errorf("failed to decode leases of cluster %s: %v", clusterName, err)
+	}
+	return &lf, nil
+}
+
+// checkSubnetOverlap fails if subnet overlaps the subnet claimed by any
+// other cluster. Callers hold the IPAM lock.
+func checkSubnetOverlap(clusterName string, subnet *net.IPNet) error {
+	entries, err := os.ReadDir(BaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", BaseDir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == clusterName {
+			continue
+		}
+
+		lf, err := readLeases(entry.Name())
+		if err != nil {
+			return err
+		}
+		if lf == nil {
+			continue
+		}
+
+		_, other, err := net.ParseCIDR(lf.Subnet)
+		if err != nil {
+			continue
+		}
+		if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+			return fmt.Errorf("subnet %s overlaps subnet %s of cluster %s", subnet, other, entry.Name())
+		}
+	}
+
+	return nil
+}
+
+// withIPAMLock runs fn while holding the host-wide IPAM lock, so clusters
+// created concurrently cannot claim overlapping subnets
+func withIPAMLock(fn func() error) error {
+	if err := os.MkdirAll(BaseDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(BaseDir, ipamLockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open IPAM lock: %v", err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to take IPAM lock: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// usableAddresses returns how many addresses of subnet can be leased,
+// capped at max
+func usableAddresses(subnet *net.IPNet, max int) int {
+	ones, bits := subnet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits >= 31 {
+		return max
+	}
+
+	// Network address and gateway, plus broadcast for IPv4
+	n := 1<<hostBits - 2
+	if bits == 32 {
+		n--
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// normalizeIP returns the 4-byte form of IPv4 addresses
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// nextIP returns the address following ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// lastIP returns the highest address of subnet
+func lastIP(subnet *net.IPNet) net.IP {
+	last := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		last[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	return last
+}
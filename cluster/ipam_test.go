@@ -0,0 +1,281 @@
+package cluster
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// inTempDir runs the test from an empty directory, so BaseDir and the
+// cluster directories under it are created there
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		network Network
+		owners  int
+		want    []string // addresses handed out, in order; "" where allocation fails
+	}{
+		{
+			name:    "skips network and gateway",
+			network: Network{SubnetCIDR: "10.10.0.0/24", Gateway: "10.10.0.1"},
+			owners:  3,
+			want:    []string{"10.10.0.2", "10.10.0.3", "10.10.0.4"},
+		},
+		{
+			name:    "skips gateway in the middle",
+			network: Network{SubnetCIDR: "10.10.0.0/29", Gateway: "10.10.0.3"},
+			owners:  3,
+			want:    []string{"10.10.0.1", "10.10.0.2", "10.10.0.4"},
+		},
+		{
+			name:    "exhausts before broadcast",
+			network: Network{SubnetCIDR: "10.10.0.0/29", Gateway: "10.10.0.1"},
+			owners:  6,
+			want:    []string{"10.10.0.2", "10.10.0.3", "10.10.0.4", "10.10.0.5", "10.10.0.6", ""},
+		},
+		{
+			name:    "IPv6 has no broadcast",
+			network: Network{SubnetCIDR: "fd00::/126", Gateway: "fd00::1"},
+			owners:  3,
+			want:    []string{"fd00::2", "fd00::3", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			a, err := OpenIPAM("test", tt.network)
+			if err != nil {
+				t.Fatalf("OpenIPAM: %v", err)
+			}
+
+			for i := 0; i < tt.owners; i++ {
+				ip, err := a.Allocate(fmt.Sprintf("node-%d", i))
+				if tt.want[i] == "" {
+					if err == nil {
+						t.Errorf("Allocate #%d = %s, want an error", i, ip)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Allocate #%d: %v", i, err)
+				}
+				if ip.String() != tt.want[i] {
+					t.Errorf("Allocate #%d = %s, want %s", i, ip, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIPAMSameOwner(t *testing.T) {
+	inTempDir(t)
+	a, err := OpenIPAM("test", Network{SubnetCIDR: "10.10.0.0/24", Gateway: "10.10.0.1"})
+	if err != nil {
+		t.Fatalf("OpenIPAM: %v", err)
+	}
+
+	first, err := a.Allocate("node-0")
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	again, err := a.Allocate("node-0")
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if !first.Equal(again) {
+		t.Errorf("second Allocate for the same owner = %s, want %s", again, first)
+	}
+}
+
+func TestIPAMRelease(t *testing.T) {
+	inTempDir(t)
+	a, err := OpenIPAM("test", Network{SubnetCIDR: "10.10.0.0/29", Gateway: "10.10.0.1"})
+	if err != nil {
+		t.Fatalf("OpenIPAM: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := a.Allocate(fmt.Sprintf("node-%d", i)); err != nil {
+			t.Fatalf("Allocate: %v", err)
+		}
+	}
+	if _, err := a.Allocate("extra"); err == nil {
+		t.Fatal("Allocate succeeded on an exhausted subnet")
+	}
+
+	if err := a.Release("node-1"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	ip, err := a.Allocate("extra")
+	if err != nil {
+		t.Fatalf("Allocate after Release: %v", err)
+	}
+	if ip.String() != "10.10.0.3" {
+		t.Errorf("Allocate after Release = %s, want the released 10.10.0.3", ip)
+	}
+
+	if err := a.Release("unknown"); err != nil {
+		t.Errorf("Release of an owner without a lease: %v", err)
+	}
+}
+
+func TestIPAMPersistence(t *testing.T) {
+	inTempDir(t)
+	network := Network{SubnetCIDR: "10.10.0.0/24", Gateway: "10.10.0.1"}
+	a, err := OpenIPAM("test", network)
+	if err != nil {
+		t.Fatalf("OpenIPAM: %v", err)
+	}
+	for _, owner := range []string{"node-0", "node-1", "node-2"} {
+		if _, err := a.Allocate(owner); err != nil {
+			t.Fatalf("Allocate: %v", err)
+		}
+	}
+	if err := a.Release("node-1"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	b, err := OpenIPAM("test", network)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	for owner, want := range map[string]string{"node-0": "10.10.0.2", "node-2": "10.10.0.4", "node-3": "10.10.0.3"} {
+		ip, err := b.Allocate(owner)
+		if err != nil {
+			t.Fatalf("Allocate(%s): %v", owner, err)
+		}
+		if ip.String() != want {
+			t.Errorf("Allocate(%s) after reopening = %s, want %s", owner, ip, want)
+		}
+	}
+
+	// The leases pin the subnet until they are released
+	if _, err := OpenIPAM("test", Network{SubnetCIDR: "10.20.0.0/24", Gateway: "10.20.0.1"}); err == nil {
+		t.Error("OpenIPAM with another subnet succeeded while leases are held")
+	}
+}
+
+func TestIPAMOverlap(t *testing.T) {
+	inTempDir(t)
+	if _, err := OpenIPAM("first", Network{SubnetCIDR: "10.10.0.0/16", Gateway: "10.10.0.1"}); err != nil {
+		t.Fatalf("OpenIPAM: %v", err)
+	}
+
+	if _, err := OpenIPAM("second", Network{SubnetCIDR: "10.10.5.0/24", Gateway: "10.10.5.1"}); err == nil {
+		t.Error("OpenIPAM with an overlapping subnet succeeded")
+	}
+	if _, err := OpenIPAM("second", Network{SubnetCIDR: "10.11.0.0/24", Gateway: "10.11.0.1"}); err != nil {
+		t.Errorf("OpenIPAM with a disjoint subnet: %v", err)
+	}
+
+	if err := releaseSubnet("first"); err != nil {
+		t.Fatalf("releaseSubnet: %v", err)
+	}
+	if _, err := OpenIPAM("third", Network{SubnetCIDR: "10.10.5.0/24", Gateway: "10.10.5.1"}); err != nil {
+		t.Errorf("OpenIPAM after the overlapping subnet was released: %v", err)
+	}
+}
+
+func TestOpenIPAMInvalid(t *testing.T) {
+	inTempDir(t)
+	for _, network := range []Network{
+		{SubnetCIDR: "10.10.0.0", Gateway: "10.10.0.1"},
+		{SubnetCIDR: "10.10.0.0/24", Gateway: "10.20.0.1"},
+		{SubnetCIDR: "10.10.0.0/24", Gateway: "gateway"},
+	} {
+		if _, err := OpenIPAM("test", network); err == nil {
+			t.Errorf("OpenIPAM(%+v) succeeded", network)
+		}
+	}
+}
+
+// newHostKey returns the public key of a new ed25519 host key
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestReleasedAddressForgetsHostKey(t *testing.T) {
+	inTempDir(t)
+	network := Network{SubnetCIDR: "10.10.0.0/24", Gateway: "10.10.0.1"}
+	c := NewCluster(ClusterConfig{Name: "test", NetworkConfig: network})
+	if err := os.MkdirAll(c.sshDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenIPAM("test", network)
+	if err != nil {
+		t.Fatalf("OpenIPAM: %v", err)
+	}
+
+	// pin connects to the node with the host key
+	pin := func(owner string, key ssh.PublicKey) error {
+		ip, err := a.Allocate(owner)
+		if err != nil {
+			t.Fatalf("Allocate(%s): %v", owner, err)
+		}
+		addr := &net.TCPAddr{IP: ip, Port: 22}
+		return c.pinHostKey(&Node{ID: owner})(addr.String(), addr, key)
+	}
+
+	removedKey, keptKey := newHostKey(t), newHostKey(t)
+	if err := pin("test-wk-0", removedKey); err != nil {
+		t.Fatalf("pinning the key of test-wk-0: %v", err)
+	}
+	if err := pin("test-wk-1", keptKey); err != nil {
+		t.Fatalf("pinning the key of test-wk-1: %v", err)
+	}
+	removed, _ := a.Allocate("test-wk-0")
+
+	// Remove test-wk-0 as removeNode does, and add a node that gets its
+	// address and a new host key
+	if err := c.forgetHostKey(removed.String()); err != nil {
+		t.Fatalf("forgetHostKey: %v", err)
+	}
+	if err := a.Release("test-wk-0"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if added, _ := a.Allocate("test-wk-2"); !added.Equal(removed) {
+		t.Fatalf("test-wk-2 leased %s, want the released %s", added, removed)
+	}
+	if err := pin("test-wk-2", newHostKey(t)); err != nil {
+		t.Errorf("pinning the key of test-wk-2 on the address of test-wk-0: %v", err)
+	}
+
+	// The keys of the other nodes stay pinned
+	if err := pin("test-wk-1", keptKey); err != nil {
+		t.Errorf("key of test-wk-1 no longer accepted: %v", err)
+	}
+	if err := pin("test-wk-1", newHostKey(t)); err == nil {
+		t.Error("another key of test-wk-1 accepted")
+	}
+
+	if err := c.forgetHostKey("10.10.0.200"); err != nil {
+		t.Errorf("forgetHostKey of an address without a key: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Defaults of the jailed mode
+const (
+	DefaultJailerPath          = "./setup/bin/jailer-v1.9.0"
+	DefaultJailedFirecracker   = "./setup/bin/firecracker" // same release as the jailer
+	DefaultJailUIDBase         = 100000
+	DefaultJailMemoryOverhead  = 64
+	cgroupRoot                 = "/sys/fs/cgroup"
+	jailSocketPath             = "/firecracker.sock"
+	jailLogFile                = "firecracker.log"
+	linkJailLogFileHandlerName = "fck8s.LinkJailLogFile"
+)
+
+// JailerConfig enables the jailed mode: every node is launched through the
+// Firecracker jailer as its own unprivileged user, chrooted, limited by a
+// cgroup and inside a network namespace of its own. Zero values take the
+// defaults above.
+type JailerConfig struct {
+	JailerBinary      string `json:"jailerBinary,omitempty"`
+	FirecrackerBinary string `json:"firecrackerBinary,omitempty"` // the jailer needs a file name containing "firecracker"
+	ChrootBaseDir     string `json:"chrootBaseDir,omitempty"`     // <cluster dir>/jail by default; must be on the filesystem of the disks and kernel so they can be hard-linked
+	UIDBase           int    `json:"uidBase,omitempty"`           // first UID and GID given to nodes
+	MemoryOverheadMB  int64  `json:"memoryOverheadMB,omitempty"`  // added to the guest memory for the cgroup memory limit
+}
+
+// validate checks the jailer settings of cfg and reports problems through add
+func (j *JailerConfig) validate(cfg ClusterConfig, add func(field, format string, args ...interface{})) {
+	if err := checkFile(pick(j.JailerBinary, DefaultJailerPath)); err != nil {
+		add("jailer.jailerBinary", "%v", err)
+	}
+
+	fc := pick(j.FirecrackerBinary, DefaultJailedFirecracker)
+	if err := checkFile(fc); err != nil {
+		add("jailer.firecrackerBinary", "%v", err)
+	} else if !strings.Contains(filepath.Base(fc), "firecracker") {
+		add("jailer.firecrackerBinary", "file name %q must contain \"firecracker\"", filepath.Base(fc))
+	}
+
+	if j.UIDBase < 0 {
+		add("jailer.uidBase", "must not be negative, got %d", j.UIDBase)
+	}
+	if j.MemoryOverheadMB < 0 {
+		add("jailer.memoryOverheadMB", "must not be negative, got %d", j.MemoryOverheadMB)
+	}
+
+	// Device-mapper disks are block devices and cannot be hard-linked into
+	// the chroot
+	if cfg.DiskProvider == DiskDMSnapshot {
+		add("diskProvider", "%q cannot be used with the jailer", DiskDMSnapshot)
+	}
+}
+
+// setDefaults fills in the jailer settings left empty
+func (j *JailerConfig) setDefaults() {
+	j.JailerBinary = pick(j.JailerBinary, DefaultJailerPath)
+	j.FirecrackerBinary = pick(j.FirecrackerBinary, DefaultJailedFirecracker)
+	j.UIDBase = pick(j.UIDBase, DefaultJailUIDBase)
+	j.MemoryOverheadMB = pick(j.MemoryOverheadMB, DefaultJailMemoryOverhead)
+}
+
+// chrootBaseDir returns the absolute directory the jailer builds the node
+// chroots in
+func (c *Cluster) chrootBaseDir() (string, error) {
+	return filepath.Abs(pick(c.Config.Jailer.ChrootBaseDir, filepath.Join(clusterDir(c.Config.Name), "jail")))
+}
+
+// jailDir returns the directory the jailer creates for the node, holding its
+// chroot
+func (c *Cluster) jailDir(node *Node) (string, error) {
+	base, err := c.chrootBaseDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, filepath.Base(c.Config.Jailer.FirecrackerBinary), node.ID), nil
+}
+
+// assignJailIDs gives every node without one a UID, used as its GID too,
+// that no node of any cluster on the host runs as
+func (c *Cluster) assignJailIDs() error {
+	return withIPAMLock(func() error {
+		used, err := hostJailUIDs(c.Config.Name)
+		if err != nil {
+			return err
+		}
+		for _, node := range c.Nodes {
+			if node.UID != 0 {
+				used[node.UID] = true
+			}
+		}
+
+		next := c.Config.Jailer.UIDBase
+		for _, node := range c.Nodes {
+			if node.UID != 0 {
+				continue
+			}
+			for used[next] {
+				next++
+			}
+			node.UID, node.GID = next, next
+			used[next] = true
+		}
+		return nil
+	})
+}
+
+// hostJailUIDs returns the UIDs of the jailed nodes of every cluster except
+// the named one
+func hostJailUIDs(except string) (map[int]bool, error) {
+	used := make(map[int]bool)
+
+	entries, err := os.ReadDir(BaseDir)
+	if os.IsNotExist(err) {
+		return used, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", BaseDir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == except {
+			continue
+		}
+		state, err := readState(entry.Name())
+		if err != nil {
+			continue
+		}
+		for _, node := range state.Nodes {
+			if node.UID != 0 {
+				used[node.UID] = true
+			}
+		}
+	}
+
+	return used, nil
+}
+
+// jailMachine switches the machine configuration of the node to jailed mode
+// and prepares what the jailer expects: no chroot left from a previous boot,
+// and a root disk and log file the node user can write
+func (c *Cluster) jailMachine(node *Node, config *firecracker.Config) error {
+	jailDir, err := c.jailDir(node)
+	if err != nil {
+		return err
+	}
+	if err := c.teardownJail(node); err != nil {
+		return err
+	}
+	if err := c.record(effectJail, node.ID, jailDir, ""); err != nil {
+		return err
+	}
+
+	if err := os.Chown(node.RootDisk, node.UID, node.GID); err != nil {
+		return fmt.Errorf("failed to hand root disk to the node user: %v", err)
+	}
+
+	// Firecracker writes its log inside the chroot. The log is hard-linked
+	// there from the node directory so it outlives the chroot.
+	logPath := filepath.Join(node.RootPath, jailLogFile)
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %v", err)
+	}
+	f.Close()
+	if err := os.Chown(logPath, node.UID, node.GID); err != nil {
+		return fmt.Errorf("failed to hand log file to the node user: %v", err)
+	}
+
+	uid, gid := node.UID, node.GID
+	config.JailerCfg = &firecracker.JailerConfig{
+		UID:            &uid,
+		GID:            &gid,
+		ID:             node.ID,
+		NumaNode:       firecracker.Int(0),
+		ExecFile:       c.Config.Jailer.FirecrackerBinary,
+		JailerBinary:   c.Config.Jailer.JailerBinary,
+		ChrootBaseDir:  filepath.Dir(filepath.Dir(jailDir)),
+		ChrootStrategy: firecracker.NewNaiveChrootStrategy(node.KernelPath),
+		CgroupVersion:  "2",
+	}
+	config.SocketPath = jailSocketPath
+	config.NetNS = c.netnsPath(node)
+	config.LogPath = "" // set by linkJailLogFile once the chroot exists
+
+	node.ChrootDir = filepath.Join(jailDir, "root")
+	node.SocketPath = filepath.Join(node.ChrootDir, jailSocketPath)
+	return nil
+}
+
+// jailerCommand builds the jailer invocation of the node. The SDK builder
+// cannot pass cgroup limits other than a NUMA cpuset, so the command is
+// built here and handed to the machine as its process runner.
+func (c *Cluster) jailerCommand(ctx context.Context, node *Node, config firecracker.Config, console *os.File) (*exec.Cmd, error) {
+	execFile, err := filepath.Abs(c.Config.Jailer.FirecrackerBinary)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryMB := node.MemSizeMB + c.Config.Jailer.MemoryOverheadMB
+	args := []string{
+		"--id", node.ID,
+		"--uid", strconv.Itoa(node.UID),
+		"--gid", strconv.Itoa(node.GID),
+		"--exec-file", execFile,
+		"--chroot-base-dir", config.JailerCfg.ChrootBaseDir,
+		"--netns", config.NetNS,
+		"--cgroup-version", "2",
+		"--cgroup", fmt.Sprintf("cpu.max=%d 100000", node.VCPUCount*100000),
+		"--cgroup", fmt.Sprintf("memory.max=%d", memoryMB<<20),
+		"--",
+		"--api-sock", jailSocketPath,
+	}
+
+	cmd := exec.CommandContext(ctx, c.Config.Jailer.JailerBinary, args...)
+	cmd.Stdin = console
+	cmd.Stdout = console
+	cmd.Stderr = console
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd, nil
+}
+
+// linkJailLogFile links the node log file into the chroot the jailer has
+// just created and points the machine logger at it
+func linkJailLogFile(node *Node) firecracker.Handler {
+	return firecracker.Handler{
+		Name: linkJailLogFileHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			if err := os.Link(filepath.Join(node.RootPath, jailLogFile), filepath.Join(node.ChrootDir, jailLogFile)); err != nil {
+				return fmt.Errorf("failed to link log file into chroot: %v", err)
+			}
+			m.Cfg.LogPath = jailLogFile
+			return nil
+		},
+	}
+}
+
+// teardownJail removes the chroot and cgroup the jailer created for the
+// node. The Firecracker process must have exited.
+func (c *Cluster) teardownJail(node *Node) error {
+	if c.Config.Jailer == nil {
+		return nil
+	}
+
+	jailDir, err := c.jailDir(node)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(jailDir); err != nil {
+		return fmt.Errorf("failed to remove chroot of node %s: %v", node.ID, err)
+	}
+
+	// The jailer names the parent cgroup after the exec file
+	cgroup := filepath.Join(cgroupRoot, filepath.Base(c.Config.Jailer.FirecrackerBinary), node.ID)
+	if err := os.Remove(cgroup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cgroup of node %s: %v", node.ID, err)
+	}
+
+	node.ChrootDir = ""
+	return nil
+}
@@ -0,0 +1,303 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"firecracker-k8s/hostnet"
+)
+
+// journalFileName is the journal of side effects in the cluster directory
+const journalFileName = "journal.json"
+
+// Kinds of side effects the journal records, each undone by undo
+const (
+	effectDir     = "dir"     // directory created; removed with its contents
+	effectFile    = "file"    // file written; removed
+	effectLease   = "lease"   // address leased to a node; released
+	effectBridge  = "bridge"  // host bridge; deleted
+	effectNAT     = "nat"     // nftables masquerade table; deleted
+	effectDisk    = "disk"    // root disk of a node; detached and removed
+	effectTap     = "tap"     // TAP device on the host; deleted
+	effectVeth    = "veth"    // veth pair to a node namespace; deleted
+	effectNetns   = "netns"   // network namespace of a jailed node; deleted
+	effectJail    = "jail"    // chroot and cgroup of a jailed node; removed
+	effectProcess = "process" // Firecracker process; terminated
+	effectLB      = "lb"      // API server load balancer; terminated
+)
+
+// SideEffect is a change provisioning made to the host
+type SideEffect struct {
+	Kind   string    `json:"kind"`
+	Node   string    `json:"node,omitempty"`   // Node the effect belongs to, if any
+	Target string    `json:"target"`           // Path, device, table or PID
+	Detail string    `json:"detail,omitempty"` // Disk provider of disks
+	At     time.Time `json:"at"`
+}
+
+func (e SideEffect) String() string {
+	if e.Node != "" {
+		return fmt.Sprintf("%s %s of node %s", e.Kind, e.Target, e.Node)
+	}
+	return fmt.Sprintf("%s %s", e.Kind, e.Target)
+}
+
+// UndoError is a side effect that could not be undone
+type UndoError struct {
+	Effect SideEffect
+	Err    error
+}
+
+func (e UndoError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Effect, e.Err)
+}
+
+// RollbackError lists every side effect a rollback left in place
+type RollbackError []UndoError
+
+func (e RollbackError) Error() string {
+	msgs := make([]string, len(e))
+	for i, ue := range e {
+		msgs[i] = ue.Error()
+	}
+	return "failed to undo:\n  " + strings.Join(msgs, "\n  ")
+}
+
+// journal records the side effects of a cluster on the host so they can be
+// undone in reverse order. Effects are recorded before they are made, so
+// undoing one that never happened must do nothing.
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	effects []SideEffect
+}
+
+// openJournal returns the journal of the cluster, reading it from the
+// cluster directory the first time
+func (c *Cluster) openJournal() (*journal, error) {
+	c.journalOnce.Do(func() {
+		j := &journal{path: filepath.Join(clusterDir(c.Config.Name), journalFileName)}
+		data, err := os.ReadFile(j.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.journalErr = fmt.Errorf("failed to read journal: %v", err)
+			return
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &j.effects); err != nil {
+				c.journalErr = fmt.Errorf("failed to decode journal %s: %v", j.path, err)
+				return
+			}
+		}
+		c.journal = j
+	})
+	return c.journal, c.journalErr
+}
+
+// record adds a side effect to the journal before it is made. Recording an
+// effect again moves it to the end; processes are recorded once per node,
+// with the PID of their last start.
+func (c *Cluster) record(kind, nodeID, target, detail string) error {
+	j, err := c.openJournal()
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i, e := range j.effects {
+		same := e.Kind == kind && e.Node == nodeID && e.Target == target
+		if (kind == effectProcess || kind == effectLB) && e.Kind == kind && e.Node == nodeID {
+			same = true
+		}
+		if same {
+			j.effects = append(j.effects[:i], j.effects[i+1:]...)
+			break
+		}
+	}
+	j.effects = append(j.effects, SideEffect{Kind: kind, Node: nodeID, Target: target, Detail: detail, At: time.Now().UTC()})
+	return j.save()
+}
+
+// forget drops the side effects of a node that were undone another way
+func (c *Cluster) forget(nodeID string) error {
+	j, err := c.openJournal()
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	kept := j.effects[:0]
+	for _, e := range j.effects {
+		if e.Node != nodeID {
+			kept = append(kept, e)
+		}
+	}
+	j.effects = kept
+	return j.save()
+}
+
+// save writes the journal, or removes it once it is empty so that undoing
+// the cluster directory does not bring it back. Callers hold the lock.
+func (j *journal) save() error {
+	if len(j.effects) == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove journal: %v", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(j.effects, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("failed to create cluster directory: %v", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// Rollback stops whatever the cluster is still doing and undoes every
+// journaled side effect in reverse order. It works on its own rather than
+// on the cluster context, which it cancels. Effects that cannot be undone
+// stay in the journal, so a later delete retries them, and are returned in
+// a RollbackError.
+func (c *Cluster) Rollback() error {
+	c.cancelFunc()
+	c.ssh.closeAll()
+
+	j, err := c.openJournal()
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	h, herr := hostnet.New()
+	if herr == nil {
+		defer h.Close()
+	}
+
+	var failed RollbackError
+	var kept []SideEffect
+	for i := len(j.effects) - 1; i >= 0; i-- {
+		e := j.effects[i]
+		if err := c.undo(e, h, herr); err != nil {
+			failed = append(failed, UndoError{Effect: e, Err: err})
+			kept = append([]SideEffect{e}, kept...)
+		}
+	}
+
+	j.effects = kept
+	if err := j.save(); err != nil {
+		return errors.Join(failed, err)
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// undo reverts one side effect. h is the host network handle, or nil with
+// herr telling why it could not be opened.
+func (c *Cluster) undo(e SideEffect, h *hostnet.Host, herr error) error {
+	switch e.Kind {
+	case effectDir:
+		return os.RemoveAll(e.Target)
+
+	case effectFile:
+		if err := os.Remove(e.Target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case effectLease:
+		if c.ipam == nil {
+			ipam, err := OpenIPAM(c.Config.Name, c.Config.NetworkConfig)
+			if err != nil {
+				return err
+			}
+			c.ipam = ipam
+		}
+		return c.ipam.Release(e.Node)
+
+	case effectBridge, effectTap, effectVeth:
+		if h == nil {
+			return herr
+		}
+		return h.DeleteLink(e.Target)
+
+	case effectNAT:
+		if h == nil {
+			return herr
+		}
+		return h.DeleteMasquerade(e.Target)
+
+	case effectNetns:
+		return hostnet.DeleteNamespace(e.Target)
+
+	case effectDisk:
+		if provider, ok := diskProviders[e.Detail]; ok {
+			if err := provider.Detach(e.Target); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(e.Target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case effectJail:
+		if c.Config.Jailer == nil {
+			return nil
+		}
+		return c.teardownJail(&Node{ID: e.Node})
+
+	case effectProcess:
+		return terminate(e.Target, c.vmmAlive(e.Node))
+
+	case effectLB:
+		return terminate(e.Target, loadBalancerAlive)
+
+	default:
+		return fmt.Errorf("unknown side effect %q", e.Kind)
+	}
+}
+
+// terminate stops the process with the given PID while alive reports it
+// running, first with SIGTERM and then with SIGKILL
+func terminate(target string, alive func(int) bool) error {
+	pid, err := strconv.Atoi(target)
+	if err != nil {
+		return fmt.Errorf("invalid PID %q", target)
+	}
+	if !alive(pid) {
+		return nil
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	for deadline := time.Now().Add(10 * time.Second); alive(pid); {
+		if time.Now().After(deadline) {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return err
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
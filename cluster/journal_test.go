@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// testJournalCluster returns a cluster whose journal lives in a temporary
+// working directory
+func testJournalCluster(t *testing.T) *Cluster {
+	t.Helper()
+	inTempDir(t)
+	return NewCluster(ClusterConfig{
+		Name:          "test",
+		NetworkConfig: Network{SubnetCIDR: "10.10.0.0/24", Gateway: "10.10.0.1"},
+	})
+}
+
+// journaled returns the kinds and targets of the journaled effects, oldest
+// first
+func journaled(t *testing.T, c *Cluster) []string {
+	t.Helper()
+	j, err := c.openJournal()
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	var out []string
+	for _, e := range j.effects {
+		out = append(out, e.Kind+" "+e.Target)
+	}
+	return out
+}
+
+func TestRecordDeduplicates(t *testing.T) {
+	c := testJournalCluster(t)
+
+	for _, e := range []struct{ kind, node, target string }{
+		{effectDir, "", "a"},
+		{effectDir, "", "b"},
+		{effectDir, "", "a"}, // moves to the end
+		{effectProcess, "n1", "100"},
+		{effectProcess, "n2", "200"},
+		{effectProcess, "n1", "101"}, // one process per node, the last PID
+		{effectLB, "", "300"},
+		{effectLB, "", "301"},
+	} {
+		if err := c.record(e.kind, e.node, e.target, ""); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	want := []string{"dir b", "dir a", "process 200", "process 101", "lb 301"}
+	if got := journaled(t, c); !slices.Equal(got, want) {
+		t.Errorf("journal = %q, want %q", got, want)
+	}
+
+	// The journal survives reopening
+	reopened := NewCluster(c.Config)
+	if got := journaled(t, reopened); !slices.Equal(got, want) {
+		t.Errorf("reopened journal = %q, want %q", got, want)
+	}
+}
+
+func TestForget(t *testing.T) {
+	c := testJournalCluster(t)
+
+	for _, e := range []struct{ kind, node, target string }{
+		{effectBridge, "", "br-test"},
+		{effectDir, "n1", "n1-dir"},
+		{effectDir, "n2", "n2-dir"},
+		{effectTap, "n1", "n1-tap"},
+	} {
+		if err := c.record(e.kind, e.node, e.target, ""); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if err := c.forget("n1"); err != nil {
+		t.Fatalf("forget: %v", err)
+	}
+
+	want := []string{"bridge br-test", "dir n2-dir"}
+	if got := journaled(t, c); !slices.Equal(got, want) {
+		t.Errorf("journal = %q, want %q", got, want)
+	}
+}
+
+func TestRollbackOrder(t *testing.T) {
+	c := testJournalCluster(t)
+
+	// Effects of unknown kinds fail to undo, which shows the order Rollback
+	// tried them in
+	for _, kind := range []string{"first", "second", "third"} {
+		if err := c.record(kind, "", "x", ""); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	err := c.Rollback()
+	var rerr RollbackError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Rollback = %v, want a RollbackError", err)
+	}
+	var tried []string
+	for _, ue := range rerr {
+		tried = append(tried, ue.Effect.Kind)
+	}
+	if want := []string{"third", "second", "first"}; !slices.Equal(tried, want) {
+		t.Errorf("undo order = %q, want %q", tried, want)
+	}
+
+	// What could not be undone stays in the journal, in its original order
+	if got, want := journaled(t, c), []string{"first x", "second x", "third x"}; !slices.Equal(got, want) {
+		t.Errorf("journal after failed rollback = %q, want %q", got, want)
+	}
+}
+
+func TestRollbackReverseDependencies(t *testing.T) {
+	c := testJournalCluster(t)
+
+	// A directory whose content was created after it can only be removed
+	// once the content is gone
+	parent, err := filepath.Abs("parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := filepath.Join(parent, "child")
+	if err := c.record(effectFile, "", parent, ""); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := os.Mkdir(parent, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.record(effectDir, "", child, ""); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(child, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if _, err := os.Stat(parent); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after Rollback: %v", parent, err)
+	}
+}
+
+func TestRollbackOfEffectsNeverMade(t *testing.T) {
+	c := testJournalCluster(t)
+
+	// A process that has exited stands in for one that never started
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	deadPID := strconv.Itoa(cmd.Process.Pid)
+
+	missing, err := filepath.Abs("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct{ kind, node, target string }{
+		{effectDir, "", filepath.Join(missing, "dir")},
+		{effectFile, "", filepath.Join(missing, "file")},
+		{effectLease, "test-wk-0", "test-wk-0"},
+		{effectDisk, "test-wk-0", filepath.Join(missing, "root.img")},
+		{effectNetns, "test-wk-0", "fck8s-test-never-created"},
+		{effectJail, "test-wk-0", "test-wk-0"},
+		{effectProcess, "test-wk-0", deadPID},
+		{effectLB, "", deadPID},
+	} {
+		if err := c.record(e.kind, e.node, e.target, ""); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Rollback(); err != nil {
+			t.Fatalf("Rollback #%d: %v", i+1, err)
+		}
+	}
+	if got := journaled(t, c); len(got) != 0 {
+		t.Errorf("journal after rollback = %q, want it empty", got)
+	}
+	if _, err := os.Stat(filepath.Join(clusterDir("test"), journalFileName)); !os.IsNotExist(err) {
+		t.Errorf("journal file left behind: %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// Cgroup drivers of the kubelet, which must match the container runtime's
+const (
+	CgroupSystemd  = "systemd"
+	CgroupCgroupfs = "cgroupfs"
+)
+
+// DefaultCRISocket is the container runtime endpoint of the node images
+const DefaultCRISocket = "unix:///run/containerd/containerd.sock"
+
+// kubeadmConfigPath is where the kubeadm configuration of a node is copied
+// before kubeadm init or join reads it
+const kubeadmConfigPath = "/etc/firecracker-k8s/kubeadm.yaml"
+
+// kubeconfigFile is the admin kubeconfig exported to the cluster directory
+const kubeconfigFile = "kubeconfig"
+
+// kubeadm configuration APIs. v1beta4 replaced v1beta3 in Kubernetes 1.31
+// and turned extra arguments from a map into a list.
+const (
+	kubeadmV1beta3 = "kubeadm.k8s.io/v1beta3"
+	kubeadmV1beta4 = "kubeadm.k8s.io/v1beta4"
+	kubeletV1beta1 = "kubelet.config.k8s.io/v1beta1"
+)
+
+var (
+	kubernetesVersionRe = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)([-+][0-9A-Za-z.+-]+)?$`)
+	featureGateRe       = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+)
+
+// KubernetesConfig is how kubeadm sets up Kubernetes on the nodes
+type KubernetesConfig struct {
+	Version      string          `json:"version,omitempty"`      // Release such as v1.31.2; the version of kubeadm on the nodes by default
+	FeatureGates map[string]bool `json:"featureGates,omitempty"` // Set on the API server, controller manager, scheduler and kubelets
+	CgroupDriver string          `json:"cgroupDriver,omitempty"` // systemd or cgroupfs; systemd by default
+	CRISocket    string          `json:"criSocket,omitempty"`    // Container runtime endpoint; containerd by default
+	CertSANs     []string        `json:"certSANs,omitempty"`     // Extra names of the API server certificate, besides the masters and the gateway
+}
+
+// validate checks the Kubernetes settings and reports problems through add
+func (kc KubernetesConfig) validate(add func(field, format string, args ...interface{})) {
+	if kc.Version != "" && !kubernetesVersionRe.MatchString(kc.Version) {
+		add("kubernetes.version", "must be a release such as v1.31.2, got %q", kc.Version)
+	}
+	for _, name := range sortedKeys(kc.FeatureGates) {
+		if !featureGateRe.MatchString(name) {
+			add("kubernetes.featureGates", "invalid feature gate name %q", name)
+		}
+	}
+	switch kc.CgroupDriver {
+	case "", CgroupSystemd, CgroupCgroupfs:
+	default:
+		add("kubernetes.cgroupDriver", "must be %q or %q, got %q", CgroupSystemd, CgroupCgroupfs, kc.CgroupDriver)
+	}
+	if kc.CRISocket != "" && !strings.HasPrefix(kc.CRISocket, "unix:///") {
+		add("kubernetes.criSocket", "must be a unix:/// URL, got %q", kc.CRISocket)
+	}
+	for i, san := range kc.CertSANs {
+		if net.ParseIP(san) == nil && !dnsDomainRe.MatchString(strings.TrimPrefix(san, "*.")) {
+			add(fmt.Sprintf("kubernetes.certSANs[%d]", i), "must be an IP address or DNS name, got %q", san)
+		}
+	}
+}
+
+// Subset of the kubeadm and kubelet configuration types the nodes are set
+// up with. Extra arguments are a map or a list depending on the API, see
+// kubeadm.extraArgs.
+
+type typeMeta struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+type apiEndpoint struct {
+	AdvertiseAddress string `json:"advertiseAddress"`
+	BindPort         int    `json:"bindPort"`
+}
+
+type nodeRegistration struct {
+	Name             string      `json:"name"`
+	CRISocket        string      `json:"criSocket"`
+	KubeletExtraArgs interface{} `json:"kubeletExtraArgs,omitempty"`
+}
+
+type initConfiguration struct {
+	typeMeta
+	LocalAPIEndpoint apiEndpoint      `json:"localAPIEndpoint"`
+	NodeRegistration nodeRegistration `json:"nodeRegistration"`
+	CertificateKey   string           `json:"certificateKey,omitempty"`
+}
+
+type networking struct {
+	PodSubnet     string `json:"podSubnet"`
+	ServiceSubnet string `json:"serviceSubnet"`
+	DNSDomain     string `json:"dnsDomain"`
+}
+
+type apiServer struct {
+	CertSANs  []string    `json:"certSANs,omitempty"`
+	ExtraArgs interface{} `json:"extraArgs,omitempty"`
+}
+
+type controlPlaneComponent struct {
+	ExtraArgs interface{} `json:"extraArgs,omitempty"`
+}
+
+type clusterConfiguration struct {
+	typeMeta
+	ClusterName          string                `json:"clusterName"`
+	KubernetesVersion    string                `json:"kubernetesVersion"`
+	ControlPlaneEndpoint string                `json:"controlPlaneEndpoint"`
+	Networking           networking            `json:"networking"`
+	APIServer            apiServer             `json:"apiServer"`
+	ControllerManager    controlPlaneComponent `json:"controllerManager"`
+	Scheduler            controlPlaneComponent `json:"scheduler"`
+}
+
+type kubeletConfiguration struct {
+	typeMeta
+	CgroupDriver string          `json:"cgroupDriver"`
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+}
+
+type bootstrapTokenDiscovery struct {
+	APIServerEndpoint string   `json:"apiServerEndpoint"`
+	Token             string   `json:"token"`
+	CACertHashes      []string `json:"caCertHashes"`
+}
+
+type discovery struct {
+	BootstrapToken bootstrapTokenDiscovery `json:"bootstrapToken"`
+}
+
+type joinControlPlane struct {
+	LocalAPIEndpoint apiEndpoint `json:"localAPIEndpoint"`
+	CertificateKey   string      `json:"certificateKey"`
+}
+
+type joinConfiguration struct {
+	typeMeta
+	Discovery        discovery         `json:"discovery"`
+	NodeRegistration nodeRegistration  `json:"nodeRegistration"`
+	ControlPlane     *joinControlPlane `json:"controlPlane,omitempty"`
+}
+
+// kubeadm is the kubeadm binary of a node, whose version decides the
+// configuration API its files are written in
+type kubeadm struct {
+	version    string // e.g. v1.31.2
+	apiVersion string
+}
+
+// kubeadmOn returns the kubeadm installed on the node
+func (c *Cluster) kubeadmOn(node *Node) (kubeadm, error) {
+	result, err := c.run(c.ctx, node, "kubeadm version -o short", nil, nil)
+	if err != nil {
+		return kubeadm{}, fmt.Errorf("failed to get kubeadm version of %s: %v", node.ID, err)
+	}
+	version := strings.TrimSpace(result.Stdout)
+	m := kubernetesVersionRe.FindStringSubmatch(version)
+	if m == nil {
+		return kubeadm{}, fmt.Errorf("unexpected kubeadm version %q on %s", version, node.ID)
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	k := kubeadm{version: "v" + strings.TrimPrefix(version, "v"), apiVersion: kubeadmV1beta4}
+	if major == 1 && minor < 31 {
+		k.apiVersion = kubeadmV1beta3
+	}
+	return k, nil
+}
+
+// extraArgs returns component flags in the form the configuration API
+// expects, or nil when there are none
+func (k kubeadm) extraArgs(args map[string]string) interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+	if k.apiVersion == kubeadmV1beta3 {
+		return args
+	}
+	var list []map[string]string
+	for _, name := range sortedKeys(args) {
+		list = append(list, map[string]string{"name": name, "value": args[name]})
+	}
+	return list
+}
+
+// kubeadmInitConfig renders the configuration kubeadm init runs with on the
+// first master
+func (c *Cluster) kubeadmInitConfig(k kubeadm, master *Node) ([]byte, error) {
+	kc := c.Config.Kubernetes
+	version := k.version
+	if kc.Version != "" {
+		version = "v" + strings.TrimPrefix(kc.Version, "v")
+	}
+
+	var gates map[string]string
+	if len(kc.FeatureGates) > 0 {
+		var list []string
+		for _, name := range sortedKeys(kc.FeatureGates) {
+			list = append(list, fmt.Sprintf("%s=%t", name, kc.FeatureGates[name]))
+		}
+		gates = map[string]string{"feature-gates": strings.Join(list, ",")}
+	}
+
+	return marshalDocuments(
+		initConfiguration{
+			typeMeta:         typeMeta{k.apiVersion, "InitConfiguration"},
+			LocalAPIEndpoint: localAPIEndpoint(master),
+			NodeRegistration: c.nodeRegistration(k, master),
+			CertificateKey:   c.certKey,
+		},
+		clusterConfiguration{
+			typeMeta:             typeMeta{k.apiVersion, "ClusterConfiguration"},
+			ClusterName:          c.Config.Name,
+			KubernetesVersion:    version,
+			ControlPlaneEndpoint: c.controlPlaneEndpoint(),
+			Networking: networking{
+				PodSubnet:     c.podCIDR(),
+				ServiceSubnet: c.serviceCIDR(),
+				DNSDomain:     c.dnsDomain(),
+			},
+			APIServer:         apiServer{CertSANs: c.apiServerCertSANs(), ExtraArgs: k.extraArgs(gates)},
+			ControllerManager: controlPlaneComponent{ExtraArgs: k.extraArgs(gates)},
+			Scheduler:         controlPlaneComponent{ExtraArgs: k.extraArgs(gates)},
+		},
+		kubeletConfiguration{
+			typeMeta:     typeMeta{kubeletV1beta1, "KubeletConfiguration"},
+			CgroupDriver: pick(kc.CgroupDriver, CgroupSystemd),
+			FeatureGates: kc.FeatureGates,
+		},
+	)
+}
+
+// kubeadmJoinConfig renders the configuration kubeadm join runs with on a
+// node, which joins the control plane when it is a master. The discovery
+// settings are those of the join command of the cluster.
+func (c *Cluster) kubeadmJoinConfig(k kubeadm, node *Node) ([]byte, error) {
+	token, err := parseJoinCommand(c.joinCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	join := joinConfiguration{
+		typeMeta:         typeMeta{k.apiVersion, "JoinConfiguration"},
+		Discovery:        discovery{BootstrapToken: token},
+		NodeRegistration: c.nodeRegistration(k, node),
+	}
+	if node.Role == "master" {
+		join.ControlPlane = &joinControlPlane{
+			LocalAPIEndpoint: localAPIEndpoint(node),
+			CertificateKey:   c.certKey,
+		}
+	}
+	return marshalDocuments(join)
+}
+
+// nodeRegistration returns how the node registers with the API server. The
+// kubelet is pinned to the node address so it never advertises another
+// interface of the guest.
+func (c *Cluster) nodeRegistration(k kubeadm, node *Node) nodeRegistration {
+	return nodeRegistration{
+		Name:             node.ID,
+		CRISocket:        pick(c.Config.Kubernetes.CRISocket, DefaultCRISocket),
+		KubeletExtraArgs: k.extraArgs(map[string]string{"node-ip": node.IP}),
+	}
+}
+
+// localAPIEndpoint returns where the API server of a master listens
+func localAPIEndpoint(node *Node) apiEndpoint {
+	port, _ := strconv.Atoi(APIServerPort)
+	return apiEndpoint{AdvertiseAddress: node.IP, BindPort: port}
+}
+
+// apiServerCertSANs returns the names the API server certificate is valid
+// for besides those kubeadm adds: the gateway, which is the host address of
+// the cluster and where the load balancer of an HA control plane listens,
+// every master and the configured extras
+func (c *Cluster) apiServerCertSANs() []string {
+	sans := []string{c.Config.NetworkConfig.Gateway}
+	for _, master := range c.masters() {
+		sans = append(sans, master.IP, master.ID)
+	}
+	sans = append(sans, c.Config.Kubernetes.CertSANs...)
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, san := range sans {
+		if !seen[san] {
+			seen[san] = true
+			out = append(out, san)
+		}
+	}
+	return out
+}
+
+// parseJoinCommand extracts the discovery settings from a join command as
+// printed by kubeadm token create --print-join-command
+func parseJoinCommand(command string) (bootstrapTokenDiscovery, error) {
+	var d bootstrapTokenDiscovery
+	fields := strings.Fields(command)
+	for i := 0; i < len(fields); i++ {
+		name, value, ok := strings.Cut(fields[i], "=")
+		if !strings.HasPrefix(name, "-") {
+			if name != "kubeadm" && name != "join" && d.APIServerEndpoint == "" {
+				d.APIServerEndpoint = fields[i]
+			}
+			continue
+		}
+		if !ok && i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+			i++
+			value = fields[i]
+		}
+		switch name {
+		case "--token":
+			d.Token = value
+		case "--discovery-token-ca-cert-hash":
+			d.CACertHashes = append(d.CACertHashes, value)
+		}
+	}
+
+	if d.APIServerEndpoint == "" || d.Token == "" || len(d.CACertHashes) == 0 {
+		return d, fmt.Errorf("join command %q lacks the API server endpoint, token or CA certificate hash", redactSecrets(command))
+	}
+	return d, nil
+}
+
+// marshalDocuments encodes the objects as one multi-document YAML stream
+func marshalDocuments(objs ...interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	for i, obj := range objs {
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			b.WriteString("---\n")
+		}
+		b.Write(out)
+	}
+	return b.Bytes(), nil
+}
+
+// kubeadmInit copies the init configuration to the first master and runs
+// kubeadm init with it. An HA control plane uploads its certificates for the
+// other masters to fetch.
+func (c *Cluster) kubeadmInit(master *Node) error {
+	k, err := c.kubeadmOn(master)
+	if err != nil {
+		return err
+	}
+	config, err := c.kubeadmInitConfig(k, master)
+	if err != nil {
+		return fmt.Errorf("failed to render kubeadm configuration: %v", err)
+	}
+	if err := c.putFile(c.ctx, master, kubeadmConfigPath, config, 0600); err != nil {
+		return fmt.Errorf("failed to copy kubeadm configuration to %s: %v", master.ID, err)
+	}
+
+	command := "kubeadm init --config=" + kubeadmConfigPath
+	if c.highlyAvailable() {
+		command += " --upload-certs"
+	}
+	return c.executeCommand(master, command)
+}
+
+// kubeadmJoin copies the join configuration to the node and runs kubeadm
+// join with it
+func (c *Cluster) kubeadmJoin(node *Node) error {
+	k, err := c.kubeadmOn(node)
+	if err != nil {
+		return err
+	}
+	config, err := c.kubeadmJoinConfig(k, node)
+	if err != nil {
+		return fmt.Errorf("failed to render kubeadm configuration: %v", err)
+	}
+	if err := c.putFile(c.ctx, node, kubeadmConfigPath, config, 0600); err != nil {
+		return fmt.Errorf("failed to copy kubeadm configuration to %s: %v", node.ID, err)
+	}
+	return c.executeCommand(node, "kubeadm join --config="+kubeadmConfigPath)
+}
+
+// kubernetesInitialized reports whether kubeadm already initialised the
+// first master, whose disk keeps the control plane across restarts
+func (c *Cluster) kubernetesInitialized() (bool, error) {
+	master := c.masters()[0]
+	result, err := c.run(c.ctx, master, "test -f "+adminKubeconfig+" && echo yes || echo no", nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check kubeadm state of %s: %v", master.ID, err)
+	}
+	return strings.TrimSpace(result.Stdout) == "yes", nil
+}
+
+// KubeconfigPath returns the path of the admin kubeconfig exported to the
+// host once the control plane is up
+func (c *Cluster) KubeconfigPath() string {
+	return filepath.Join(clusterDir(c.Config.Name), kubeconfigFile)
+}
+
+// exportKubeconfig copies the admin kubeconfig kubeadm wrote on the master
+// to the cluster directory, pointed at the control plane endpoint so kubectl
+// on the host can use it as is
+func (c *Cluster) exportKubeconfig(master *Node) error {
+	data, err := c.getFile(c.ctx, master, adminKubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to fetch kubeconfig from %s: %v", master.ID, err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		return fmt.Errorf("invalid kubeconfig on %s: %v", master.ID, err)
+	}
+	for _, cluster := range config.Clusters {
+		cluster.Server = "https://" + c.controlPlaneEndpoint()
+	}
+	if err := clientcmd.WriteToFile(*config, c.KubeconfigPath()); err != nil {
+		return fmt.Errorf("failed to write kubeconfig: %v", err)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
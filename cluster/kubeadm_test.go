@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// sha256Hex stands in for the CA certificate hash of join commands
+const sha256Hex = "2d0e1f8a9b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e"
+
+// checkGolden compares got with the named file in testdata, or rewrites the
+// file with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file; got:\n%s", path, got)
+	}
+}
+
+// testKubeadmCluster returns a cluster of one master and one worker, or
+// three masters and one worker when ha is set
+func testKubeadmCluster(ha bool) *Cluster {
+	c := &Cluster{
+		Config: ClusterConfig{
+			Name: "test",
+			NetworkConfig: Network{
+				SubnetCIDR: "172.16.0.0/24",
+				Gateway:    "172.16.0.1",
+			},
+			Kubernetes: KubernetesConfig{
+				FeatureGates: map[string]bool{"InPlacePodVerticalScaling": true, "SidecarContainers": false},
+				CertSANs:     []string{"k8s.example.com"},
+			},
+		},
+		Nodes: []*Node{
+			{ID: "test-master-1", Role: "master", IP: "172.16.0.2"},
+			{ID: "test-worker-1", Role: "worker", IP: "172.16.0.3"},
+		},
+		joinCommand: "kubeadm join 172.16.0.2:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash sha256:" + sha256Hex,
+		certKey:     "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	if ha {
+		c.Nodes = append(c.Nodes,
+			&Node{ID: "test-master-2", Role: "master", IP: "172.16.0.4"},
+			&Node{ID: "test-master-3", Role: "master", IP: "172.16.0.5"},
+		)
+	}
+	return c
+}
+
+func TestKubeadmConfigGolden(t *testing.T) {
+	versions := []struct {
+		name string
+		k    kubeadm
+	}{
+		{"v1beta3", kubeadm{version: "v1.30.4", apiVersion: kubeadmV1beta3}},
+		{"v1beta4", kubeadm{version: "v1.31.2", apiVersion: kubeadmV1beta4}},
+	}
+
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			c := testKubeadmCluster(false)
+			init, err := c.kubeadmInitConfig(v.k, c.Nodes[0])
+			if err != nil {
+				t.Fatalf("kubeadmInitConfig: %v", err)
+			}
+			checkGolden(t, "kubeadm-init-"+v.name+".yaml", init)
+
+			join, err := c.kubeadmJoinConfig(v.k, c.Nodes[1])
+			if err != nil {
+				t.Fatalf("kubeadmJoinConfig: %v", err)
+			}
+			checkGolden(t, "kubeadm-join-worker-"+v.name+".yaml", join)
+
+			ha := testKubeadmCluster(true)
+			init, err = ha.kubeadmInitConfig(v.k, ha.Nodes[0])
+			if err != nil {
+				t.Fatalf("kubeadmInitConfig: %v", err)
+			}
+			checkGolden(t, "kubeadm-init-ha-"+v.name+".yaml", init)
+
+			join, err = ha.kubeadmJoinConfig(v.k, ha.Nodes[2])
+			if err != nil {
+				t.Fatalf("kubeadmJoinConfig: %v", err)
+			}
+			checkGolden(t, "kubeadm-join-master-"+v.name+".yaml", join)
+		})
+	}
+}
+
+func TestParseJoinCommand(t *testing.T) {
+	hash := "sha256:" + sha256Hex
+	tests := []struct {
+		name    string
+		command string
+		want    bootstrapTokenDiscovery
+		wantErr bool
+	}{
+		{
+			name:    "printed by kubeadm",
+			command: "kubeadm join 172.16.0.2:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash " + hash + " \n",
+			want:    bootstrapTokenDiscovery{APIServerEndpoint: "172.16.0.2:6443", Token: "abcdef.0123456789abcdef", CACertHashes: []string{hash}},
+		},
+		{
+			name:    "flags with equals signs",
+			command: "kubeadm join --token=abcdef.0123456789abcdef 172.16.0.1:6443 --discovery-token-ca-cert-hash=" + hash,
+			want:    bootstrapTokenDiscovery{APIServerEndpoint: "172.16.0.1:6443", Token: "abcdef.0123456789abcdef", CACertHashes: []string{hash}},
+		},
+		{
+			name:    "line continuations and control plane flags",
+			command: "kubeadm join 172.16.0.1:6443 --token abcdef.0123456789abcdef \\\n\t--discovery-token-ca-cert-hash " + hash + " \\\n\t--control-plane --certificate-key 0123",
+			want:    bootstrapTokenDiscovery{APIServerEndpoint: "172.16.0.1:6443", Token: "abcdef.0123456789abcdef", CACertHashes: []string{hash}},
+		},
+		{
+			name:    "several CA hashes",
+			command: "kubeadm join 172.16.0.2:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash sha256:aa --discovery-token-ca-cert-hash sha256:bb",
+			want:    bootstrapTokenDiscovery{APIServerEndpoint: "172.16.0.2:6443", Token: "abcdef.0123456789abcdef", CACertHashes: []string{"sha256:aa", "sha256:bb"}},
+		},
+		{
+			name:    "empty",
+			command: "",
+			wantErr: true,
+		},
+		{
+			name:    "no endpoint",
+			command: "kubeadm join --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash " + hash,
+			wantErr: true,
+		},
+		{
+			name:    "no token",
+			command: "kubeadm join 172.16.0.2:6443 --discovery-token-ca-cert-hash " + hash,
+			wantErr: true,
+		},
+		{
+			name:    "no CA hash",
+			command: "kubeadm join 172.16.0.2:6443 --token abcdef.0123456789abcdef",
+			wantErr: true,
+		},
+		{
+			name:    "error output",
+			command: "failed to create or update bootstrap token with name bootstrap-token-abcdef: Unauthorized",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJoinCommand(tt.command)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseJoinCommand succeeded with %+v", got)
+				}
+				if bytes.Contains([]byte(err.Error()), []byte("0123456789abcdef")) {
+					t.Errorf("error leaks the token: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJoinCommand: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJoinCommand = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleJoinTokens(t *testing.T) {
+	// kubeadm token list -o json prints one object per token
+	list := `{
+    "kind": "BootstrapToken",
+    "apiVersion": "output.kubeadm.k8s.io/v1alpha3",
+    "token": "aaaaaa.0123456789abcdef",
+    "description": "firecracker-k8s join token",
+    "ttl": "23h59m0s",
+    "usages": ["authentication", "signing"],
+    "groups": ["system:bootstrappers:kubeadm:default-node-token"]
+}
+{
+    "kind": "BootstrapToken",
+    "apiVersion": "output.kubeadm.k8s.io/v1alpha3",
+    "token": "bbbbbb.0123456789abcdef",
+    "description": "created by hand",
+    "usages": ["authentication", "signing"]
+}
+{
+    "kind": "BootstrapToken",
+    "apiVersion": "output.kubeadm.k8s.io/v1alpha3",
+    "token": "cccccc.0123456789abcdef",
+    "description": "firecracker-k8s join token"
+}
+`
+	got, err := staleJoinTokens(list, "cccccc")
+	if err != nil {
+		t.Fatalf("staleJoinTokens: %v", err)
+	}
+	if want := []string{"aaaaaa"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("staleJoinTokens = %q, want %q", got, want)
+	}
+
+	if got, err := staleJoinTokens("", "cccccc"); err != nil || len(got) != 0 {
+		t.Errorf("staleJoinTokens of no tokens = %q, %v", got, err)
+	}
+	if _, err := staleJoinTokens("no bootstrap token found", "cccccc"); err == nil {
+		t.Error("staleJoinTokens accepted text output")
+	}
+}
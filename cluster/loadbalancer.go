@@ -0,0 +1,194 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"firecracker-k8s/lb"
+)
+
+// LoadBalancerCommand is the hidden subcommand of the running executable
+// that balances the API server port of an HA control plane, see lb. The
+// program embedding this package must dispatch it to RunLoadBalancer.
+const LoadBalancerCommand = "api-lb"
+
+// APIServerPort is the port of the Kubernetes API server, on the control
+// plane nodes and on the load balancer in front of them
+const APIServerPort = "6443"
+
+// loadBalancerLogFile is the log of the load balancer in the cluster
+// directory
+const loadBalancerLogFile = "api-lb.log"
+
+// masters returns the control plane nodes, the first one being the node
+// kubeadm init runs on
+func (c *Cluster) masters() []*Node {
+	var masters []*Node
+	for _, node := range c.Nodes {
+		if node.Role == "master" {
+			masters = append(masters, node)
+		}
+	}
+	return masters
+}
+
+// workers returns the worker nodes
+func (c *Cluster) workers() []*Node {
+	var workers []*Node
+	for _, node := range c.Nodes {
+		if node.Role == "worker" {
+			workers = append(workers, node)
+		}
+	}
+	return workers
+}
+
+// runningMaster returns the first control plane node that is running, which
+// cluster-wide kubeadm and kubectl commands run on
+func (c *Cluster) runningMaster() (*Node, error) {
+	for _, master := range c.masters() {
+		if master.Status == NodeRunning {
+			return master, nil
+		}
+	}
+	return nil, fmt.Errorf("no control plane node of cluster %s is running", c.Config.Name)
+}
+
+// highlyAvailable reports whether the cluster runs several control plane
+// nodes behind the host load balancer
+func (c *Cluster) highlyAvailable() bool {
+	return len(c.masters()) > 1
+}
+
+// controlPlaneEndpoint returns the host:port every node and kubeconfig
+// reaches the API server at: the load balancer on the gateway for an HA
+// control plane, the only master otherwise
+func (c *Cluster) controlPlaneEndpoint() string {
+	if c.highlyAvailable() {
+		return net.JoinHostPort(c.Config.NetworkConfig.Gateway, APIServerPort)
+	}
+	if masters := c.masters(); len(masters) > 0 {
+		return net.JoinHostPort(masters[0].IP, APIServerPort)
+	}
+	return ""
+}
+
+// startLoadBalancer starts the load balancer of an HA control plane unless
+// it is already running. It runs in its own session, like the VMMs, so it
+// outlives the command that started it.
+func (c *Cluster) startLoadBalancer() error {
+	if !c.highlyAvailable() || loadBalancerAlive(c.lbPID) {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find load balancer executable: %v", err)
+	}
+
+	args := []string{LoadBalancerCommand, "-listen", c.controlPlaneEndpoint()}
+	for _, master := range c.masters() {
+		args = append(args, "-backend", net.JoinHostPort(master.IP, APIServerPort))
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(clusterDir(c.Config.Name), loadBalancerLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open load balancer log: %v", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start load balancer: %v", err)
+	}
+	go cmd.Wait()
+	c.lbPID = cmd.Process.Pid
+	if err := c.record(effectLB, "", strconv.Itoa(c.lbPID), ""); err != nil {
+		return err
+	}
+
+	// Fail now rather than in kubeadm if the port cannot be bound
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.DialTimeout("tcp", c.controlPlaneEndpoint(), time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if !loadBalancerAlive(c.lbPID) {
+			c.lbPID = 0
+			return fmt.Errorf("load balancer exited, see %s", filepath.Join(clusterDir(c.Config.Name), loadBalancerLogFile))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("load balancer is not listening on %s: %v", c.controlPlaneEndpoint(), err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stopLoadBalancer stops the load balancer if it is running
+func (c *Cluster) stopLoadBalancer() error {
+	if !loadBalancerAlive(c.lbPID) {
+		c.lbPID = 0
+		return nil
+	}
+	if err := syscall.Kill(c.lbPID, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to stop load balancer %d: %v", c.lbPID, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); loadBalancerAlive(c.lbPID); {
+		if time.Now().After(deadline) {
+			syscall.Kill(c.lbPID, syscall.SIGKILL)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.lbPID = 0
+	return nil
+}
+
+// loadBalancerAlive reports whether pid is a running load balancer. The
+// command line is checked so a recycled PID is not mistaken for it.
+func loadBalancerAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(cmdline), LoadBalancerCommand)
+}
+
+// RunLoadBalancer runs the load balancer started by startLoadBalancer until
+// ctx is done
+func RunLoadBalancer(ctx context.Context, listen string, backends []string) error {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	return lb.New(backends, logger).Serve(ctx, listen)
+}
+
+// newCertificateKey returns a key kubeadm encrypts the uploaded control
+// plane certificates with, so the other masters can fetch them when joining
+func newCertificateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate certificate key: %v", err)
+	}
+	return hex.EncodeToString(key), nil
+}
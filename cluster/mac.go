@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// MAC address schemes
+const (
+	// MACFromIP derives the MAC from the node's IPv4 address as 06:00
+	// followed by the four address bytes, the convention fcnet-setup.sh in
+	// the guest uses to configure its address
+	MACFromIP = "ip"
+
+	// MACFromHash hashes the cluster name and node ID into a locally
+	// administered unicast MAC starting with 02
+	MACFromHash = "hash"
+)
+
+// macScheme returns the MAC scheme of the cluster, defaulting to MACFromIP
+// for IPv4 subnets and MACFromHash otherwise
+func (n Network) macScheme() string {
+	if n.MACScheme != "" {
+		return n.MACScheme
+	}
+	if ip, _, err := net.ParseCIDR(n.SubnetCIDR); err == nil && ip.To4() == nil {
+		return MACFromHash
+	}
+	return MACFromIP
+}
+
+// assignMACs gives every node without a MAC address one that is not used by
+// any node of any cluster on the host
+func (c *Cluster) assignMACs() error {
+	return withIPAMLock(func() error {
+		used, err := hostMACs(c.Config.Name)
+		if err != nil {
+			return err
+		}
+		for _, node := range c.Nodes {
+			if node.MacAddress != "" {
+				used[node.MacAddress] = node.ID
+			}
+		}
+
+		for _, node := range c.Nodes {
+			if node.MacAddress != "" {
+				continue
+			}
+			mac, err := c.newMAC(node, used)
+			if err != nil {
+				return fmt.Errorf("failed to assign a MAC address to node %s: %v", node.ID, err)
+			}
+			node.MacAddress = mac
+			used[mac] = node.ID
+		}
+		return nil
+	})
+}
+
+// newMAC derives the MAC address of the node, avoiding the addresses in used
+func (c *Cluster) newMAC(node *Node, used map[string]string) (string, error) {
+	switch scheme := c.Config.NetworkConfig.macScheme(); scheme {
+	case MACFromIP:
+		ip := net.ParseIP(node.IP).To4()
+		if ip == nil {
+			return "", fmt.Errorf("scheme %q needs an IPv4 address, got %q", scheme, node.IP)
+		}
+		mac := net.HardwareAddr{0x06, 0x00, ip[0], ip[1], ip[2], ip[3]}.String()
+		if owner, taken := used[mac]; taken {
+			return "", fmt.Errorf("%s is already used by node %s", mac, owner)
+		}
+		return mac, nil
+
+	case MACFromHash:
+		// Rehash with a counter until the address is free
+		for i := 0; i < 1000; i++ {
+			seed := fmt.Sprintf("%s/%s", c.Config.Name, node.ID)
+			if i > 0 {
+				seed = fmt.Sprintf("%s#%d", seed, i)
+			}
+			sum := sha256.Sum256([]byte(seed))
+			mac := net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], sum[4]}.String()
+			if _, taken := used[mac]; !taken {
+				return mac, nil
+			}
+		}
+		return "", fmt.Errorf("no free address found")
+
+	default:
+		return "", fmt.Errorf("unknown MAC scheme %q", scheme)
+	}
+}
+
+// hostMACs returns the MAC addresses of the nodes of every cluster except
+// the named one, mapped to the ID of the node using them
+func hostMACs(except string) (map[string]string, error) {
+	used := make(map[string]string)
+
+	entries, err := os.ReadDir(BaseDir)
+	if os.IsNotExist(err) {
+		return used, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", BaseDir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == except {
+			continue
+		}
+		state, err := readState(entry.Name())
+		if err != nil {
+			continue
+		}
+		for _, node := range state.Nodes {
+			if node.MacAddress != "" {
+				used[strings.ToLower(node.MacAddress)] = node.ID
+			}
+		}
+	}
+
+	return used, nil
+}
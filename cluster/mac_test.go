@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestMACFromIP(t *testing.T) {
+	c := &Cluster{Config: ClusterConfig{Name: "test", NetworkConfig: Network{SubnetCIDR: "172.16.0.0/24"}}}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"172.16.0.2", "06:00:ac:10:00:02"},
+		{"10.0.255.254", "06:00:0a:00:ff:fe"},
+		{"192.168.1.100", "06:00:c0:a8:01:64"},
+	}
+	for _, tt := range tests {
+		mac, err := c.newMAC(&Node{ID: "node", IP: tt.ip}, map[string]string{})
+		if err != nil {
+			t.Errorf("newMAC(%s): %v", tt.ip, err)
+			continue
+		}
+		if mac != tt.want {
+			t.Errorf("newMAC(%s) = %s, want %s", tt.ip, mac, tt.want)
+		}
+	}
+
+	if _, err := c.newMAC(&Node{ID: "node", IP: "fd00::2"}, map[string]string{}); err == nil {
+		t.Error("newMAC with an IPv6 address succeeded")
+	}
+	used := map[string]string{"06:00:ac:10:00:02": "other"}
+	if _, err := c.newMAC(&Node{ID: "node", IP: "172.16.0.2"}, used); err == nil {
+		t.Error("newMAC succeeded with its address already in use")
+	}
+}
+
+func TestMACFromHash(t *testing.T) {
+	c := &Cluster{Config: ClusterConfig{Name: "test", NetworkConfig: Network{SubnetCIDR: "fd00::/64"}}}
+	node := &Node{ID: "test-master-1", IP: "fd00::2"}
+
+	mac, err := c.newMAC(node, map[string]string{})
+	if err != nil {
+		t.Fatalf("newMAC: %v", err)
+	}
+	sum := sha256.Sum256([]byte("test/test-master-1"))
+	if want := (net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], sum[4]}).String(); mac != want {
+		t.Errorf("newMAC = %s, want %s", mac, want)
+	}
+
+	again, err := c.newMAC(node, map[string]string{})
+	if err != nil {
+		t.Fatalf("newMAC: %v", err)
+	}
+	if again != mac {
+		t.Errorf("newMAC is not deterministic: %s, then %s", mac, again)
+	}
+
+	// A taken address is rehashed with a counter
+	next, err := c.newMAC(node, map[string]string{mac: "other"})
+	if err != nil {
+		t.Fatalf("newMAC: %v", err)
+	}
+	sum = sha256.Sum256([]byte("test/test-master-1#1"))
+	if want := (net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], sum[4]}).String(); next != want {
+		t.Errorf("newMAC with %s taken = %s, want %s", mac, next, want)
+	}
+}
+
+func TestMACBits(t *testing.T) {
+	for _, subnet := range []string{"172.16.0.0/24", "fd00::/64"} {
+		network := Network{SubnetCIDR: subnet}
+		c := &Cluster{Config: ClusterConfig{Name: "test", NetworkConfig: network}}
+		used := map[string]string{}
+		for i := 0; i < 50; i++ {
+			ip := fmt.Sprintf("172.16.0.%d", i+2)
+			if network.macScheme() == MACFromHash {
+				ip = fmt.Sprintf("fd00::%x", i+2)
+			}
+			node := &Node{ID: fmt.Sprintf("test-worker-%d", i), IP: ip}
+
+			s, err := c.newMAC(node, used)
+			if err != nil {
+				t.Fatalf("newMAC(%s): %v", node.ID, err)
+			}
+			used[s] = node.ID
+
+			mac, err := net.ParseMAC(s)
+			if err != nil {
+				t.Fatalf("newMAC(%s) = %q: %v", node.ID, s, err)
+			}
+			if mac[0]&0x02 == 0 {
+				t.Errorf("%s (%s scheme) is not locally administered", s, network.macScheme())
+			}
+			if mac[0]&0x01 != 0 {
+				t.Errorf("%s (%s scheme) is not unicast", s, network.macScheme())
+			}
+		}
+	}
+}
+
+func TestMACScheme(t *testing.T) {
+	tests := []struct {
+		network Network
+		want    string
+	}{
+		{Network{SubnetCIDR: "172.16.0.0/24"}, MACFromIP},
+		{Network{SubnetCIDR: "fd00::/64"}, MACFromHash},
+		{Network{SubnetCIDR: "172.16.0.0/24", MACScheme: MACFromHash}, MACFromHash},
+	}
+	for _, tt := range tests {
+		if got := tt.network.macScheme(); got != tt.want {
+			t.Errorf("macScheme(%+v) = %s, want %s", tt.network, got, tt.want)
+		}
+	}
+}
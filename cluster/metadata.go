@@ -0,0 +1,278 @@
+package cluster
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// MetadataSchemaVersion identifies the layout of NodeMetadata
+const MetadataSchemaVersion = "firecracker-k8s/metadata/v1"
+
+// MMDSAddress is the link-local address guests reach the metadata service at
+const MMDSAddress = "169.254.169.254"
+
+// MetadataSchema is the JSON schema of the node metadata document
+//
+//go:embed metadata.schema.json
+var MetadataSchema string
+
+// NodeMetadata is the document the Firecracker metadata service (MMDS)
+// serves to a node, so the guest can configure itself at boot. Its layout is
+// described by MetadataSchema.
+type NodeMetadata struct {
+	SchemaVersion string             `json:"schemaVersion"`
+	Cluster       string             `json:"cluster"`
+	Node          MetadataNode       `json:"node"`
+	Network       MetadataNetwork    `json:"network"`
+	SSH           MetadataSSH        `json:"ssh"`
+	Kubernetes    MetadataKubernetes `json:"kubernetes"`
+}
+
+type MetadataNode struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Role     string `json:"role"`
+	Pool     string `json:"pool"`
+}
+
+type MetadataNetwork struct {
+	MAC     string `json:"mac"`
+	Address string `json:"address"` // IP with the subnet prefix length
+	Gateway string `json:"gateway"`
+}
+
+type MetadataSSH struct {
+	User           string   `json:"user"`
+	AuthorizedKeys []string `json:"authorizedKeys"`
+}
+
+type MetadataKubernetes struct {
+	ControlPlaneEndpoint string `json:"controlPlaneEndpoint"`
+	PodCIDR              string `json:"podCIDR"`
+	ServiceCIDR          string `json:"serviceCIDR"`
+	DNSDomain            string `json:"dnsDomain"`
+	JoinCommand          string `json:"joinCommand,omitempty"` // workers only, once the control plane is up
+}
+
+// nodeMetadata builds the metadata document of the node
+func (c *Cluster) nodeMetadata(node *Node) (*NodeMetadata, error) {
+	_, subnet, err := net.ParseCIDR(c.Config.NetworkConfig.SubnetCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %v", c.Config.NetworkConfig.SubnetCIDR, err)
+	}
+	ones, _ := subnet.Mask.Size()
+
+	authorizedKey, err := os.ReadFile(c.SSHKeyPath() + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH public key: %v", err)
+	}
+
+	md := &NodeMetadata{
+		SchemaVersion: MetadataSchemaVersion,
+		Cluster:       c.Config.Name,
+		Node: MetadataNode{
+			ID:       node.ID,
+			Hostname: node.ID,
+			Role:     node.Role,
+			Pool:     node.Pool,
+		},
+		Network: MetadataNetwork{
+			MAC:     node.MacAddress,
+			Address: fmt.Sprintf("%s/%d", node.IP, ones),
+			Gateway: c.Config.NetworkConfig.Gateway,
+		},
+		SSH: MetadataSSH{
+			User:           node.Username,
+			AuthorizedKeys: []string{strings.TrimSpace(string(authorizedKey))},
+		},
+	}
+	md.Kubernetes = MetadataKubernetes{
+		ControlPlaneEndpoint: c.controlPlaneEndpoint(),
+		PodCIDR:              c.podCIDR(),
+		ServiceCIDR:          c.serviceCIDR(),
+		DNSDomain:            c.dnsDomain(),
+	}
+	if node.Role == "worker" {
+		md.Kubernetes.JoinCommand = c.joinCommand
+	}
+	return md, nil
+}
+
+// configureMMDS enables the metadata service on the node interface and has
+// the machine load the node metadata before it boots
+func (c *Cluster) configureMMDS(node *Node, config *firecracker.Config) (firecracker.Handler, error) {
+	md, err := c.nodeMetadata(node)
+	if err != nil {
+		return firecracker.Handler{}, err
+	}
+
+	config.MmdsVersion = firecracker.MMDSv2
+	config.MmdsAddress = net.ParseIP(MMDSAddress)
+	for i := range config.NetworkInterfaces {
+		config.NetworkInterfaces[i].AllowMMDS = true
+	}
+	return firecracker.NewSetMetadataHandler(md), nil
+}
+
+// runningMachine returns the machine of a running node
+func (c *Cluster) runningMachine(nodeID string) (*firecracker.Machine, error) {
+	node, err := c.Node(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if node.Status != NodeRunning || node.Machine == nil {
+		return nil, fmt.Errorf("node %s is not running", node.ID)
+	}
+	return node.Machine, nil
+}
+
+// Metadata returns the metadata document the node currently sees
+func (c *Cluster) Metadata(ctx context.Context, nodeID string) (*NodeMetadata, error) {
+	m, err := c.runningMachine(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var md NodeMetadata
+	if err := m.GetMetadata(ctx, &md); err != nil {
+		return nil, fmt.Errorf("failed to read metadata of node %s: %v", nodeID, err)
+	}
+	return &md, nil
+}
+
+// UpdateMetadata merges patch into the metadata document of a running node,
+// following JSON merge patch rules: fields set in patch replace those of the
+// document and null fields remove them
+func (c *Cluster) UpdateMetadata(ctx context.Context, nodeID string, patch interface{}) error {
+	m, err := c.runningMachine(nodeID)
+	if err != nil {
+		return err
+	}
+
+	if err := m.UpdateMetadata(ctx, patch); err != nil {
+		return fmt.Errorf("failed to update metadata of node %s: %v", nodeID, err)
+	}
+	return nil
+}
+
+// joinTokenDescription describes the join tokens created for the cluster,
+// telling them apart from tokens created by hand in kubeadm token list
+const joinTokenDescription = "firecracker-k8s join token"
+
+// RotateJoinToken creates a new kubeadm join token on the master, publishes
+// the new join command to the metadata of every running worker and then
+// deletes the token it replaces. When no running worker shows which token
+// that is, every other join token of the cluster is deleted.
+func (c *Cluster) RotateJoinToken(ctx context.Context) (string, error) {
+	master, err := c.runningMaster()
+	if err != nil {
+		return "", err
+	}
+	previous := c.joinCommand
+	if previous == "" {
+		previous = c.publishedJoinCommand(ctx)
+	}
+
+	joinCommand, err := c.getJoinCommand(master)
+	if err != nil {
+		return "", err
+	}
+	c.joinCommand = joinCommand
+
+	if err := c.publishJoinCommand(ctx); err != nil {
+		return "", err
+	}
+
+	current, err := parseJoinCommand(joinCommand)
+	if err != nil {
+		return "", err
+	}
+	currentID, _, _ := strings.Cut(current.Token, ".")
+
+	// Tokens are named by the part before the dot
+	var stale []string
+	if old, err := parseJoinCommand(previous); err == nil {
+		if id, _, _ := strings.Cut(old.Token, "."); id != currentID {
+			stale = append(stale, id)
+		}
+	} else {
+		result, err := c.run(ctx, master, "kubeadm token list -o json", nil, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to list join tokens: %v", err)
+		}
+		if stale, err = staleJoinTokens(result.Stdout, currentID); err != nil {
+			return "", err
+		}
+	}
+
+	// One that expired meanwhile is already gone
+	for _, id := range stale {
+		_, err := c.run(ctx, master, "kubeadm token delete "+shellQuote(id), nil, nil)
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			return "", fmt.Errorf("failed to delete previous join token: %v", err)
+		}
+	}
+	return joinCommand, nil
+}
+
+// staleJoinTokens returns the IDs of the join tokens of the cluster other
+// than currentID in the output of kubeadm token list -o json, a stream of
+// one object per token
+func staleJoinTokens(list, currentID string) ([]string, error) {
+	var ids []string
+	dec := json.NewDecoder(strings.NewReader(list))
+	for {
+		var token struct {
+			Token       string `json:"token"`
+			Description string `json:"description"`
+		}
+		if err := dec.Decode(&token); err == io.EOF {
+			return ids, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse join tokens: %v", err)
+		}
+		id, _, _ := strings.Cut(token.Token, ".")
+		if token.Description == joinTokenDescription && id != currentID {
+			ids = append(ids, id)
+		}
+	}
+}
+
+// publishedJoinCommand returns the join command in the metadata of the
+// running workers, which is all a new process knows of the current token
+func (c *Cluster) publishedJoinCommand(ctx context.Context) string {
+	for _, node := range c.workers() {
+		if node.Status != NodeRunning {
+			continue
+		}
+		if md, err := c.Metadata(ctx, node.ID); err == nil && md.Kubernetes.JoinCommand != "" {
+			return md.Kubernetes.JoinCommand
+		}
+	}
+	return ""
+}
+
+// publishJoinCommand writes the current join command to the metadata of
+// every running worker
+func (c *Cluster) publishJoinCommand(ctx context.Context) error {
+	patch := map[string]interface{}{
+		"kubernetes": map[string]interface{}{"joinCommand": c.joinCommand},
+	}
+	for _, node := range c.Nodes {
+		if node.Role != "worker" || node.Status != NodeRunning {
+			continue
+		}
+		if err := c.UpdateMetadata(ctx, node.ID, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"firecracker-k8s/hostnet"
+)
+
+// Defaults of the Kubernetes networks
+const (
+	DefaultServiceCIDR = "10.96.0.0/12"
+	DefaultDNSDomain   = "cluster.local"
+)
+
+var dnsDomainRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// bridgeName returns the name of the host bridge the cluster's TAP devices
+// are attached to
+func (c *Cluster) bridgeName() string {
+	return bridgeName(c.Config.Name)
+}
+
+// bridgeName is br-<cluster>, or br-<tag> when that is too long. Validate
+// rejects cluster names that look like a tag, so the two forms never meet.
+func bridgeName(clusterName string) string {
+	if name := fmt.Sprintf("br-%s", clusterName); len(name) <= maxTapNameLen {
+		return name
+	}
+	return fmt.Sprintf("br-%s", interfaceTag(clusterName))
+}
+
+// interfaceTag returns a short tag standing for the cluster in the names of
+// its network interfaces, which the kernel limits to 15 characters
+func interfaceTag(clusterName string) string {
+	sum := sha256.Sum256([]byte(clusterName))
+	return hex.EncodeToString(sum[:3])
+}
+
+// nodeTag shortens the ID of a node of the cluster to its role and index,
+// such as m for <cluster>-ms, m1 for <cluster>-ms-1 and w12 for
+// <cluster>-wk-12
+func nodeTag(clusterName, nodeID string) string {
+	role, index, _ := strings.Cut(strings.TrimPrefix(nodeID, clusterName+"-"), "-")
+	if role == "" {
+		return index
+	}
+	return role[:1] + index
+}
+
+// nodeTapName returns the name of the TAP device of a node of the cluster, such
+// as tap1a2b3cw12, which stays within the kernel limit whatever the length
+// of the cluster name
+func nodeTapName(clusterName, nodeID string) string {
+	return fmt.Sprintf("tap%s%s", interfaceTag(clusterName), nodeTag(clusterName, nodeID))
+}
+
+// serviceCIDR returns the service network of the cluster
+func (c *Cluster) serviceCIDR() string {
+	return pick(c.Config.NetworkConfig.ServiceCIDR, DefaultServiceCIDR)
+}
+
+// dnsDomain returns the DNS domain of the cluster services
+func (c *Cluster) dnsDomain() string {
+	return pick(c.Config.NetworkConfig.DNSDomain, DefaultDNSDomain)
+}
+
+// validateNetworks checks that the node subnet, pod network and service
+// network are distinct from each other and from the networks the host
+// already routes, except through the bridge of the cluster itself
+func (cfg ClusterConfig) validateNetworks(add func(field, format string, args ...interface{})) {
+	type network struct {
+		field string
+		cidr  *net.IPNet
+	}
+	var networks []network
+	for _, n := range []struct{ field, cidr string }{
+		{"networkConfig.subnetCIDR", cfg.NetworkConfig.SubnetCIDR},
+		{"networkConfig.podCIDR", pick(cfg.NetworkConfig.PodCIDR, DefaultPodCIDR)},
+		{"networkConfig.serviceCIDR", pick(cfg.NetworkConfig.ServiceCIDR, DefaultServiceCIDR)},
+	} {
+		_, cidr, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			// The node subnet is reported by Validate
+			if n.field != "networkConfig.subnetCIDR" {
+				add(n.field, "invalid CIDR %q", n.cidr)
+			}
+			continue
+		}
+		networks = append(networks, network{n.field, cidr})
+	}
+
+	for i, a := range networks {
+		for _, b := range networks[i+1:] {
+			if cidrsOverlap(a.cidr, b.cidr) {
+				add(b.field, "%s overlaps %s %s", b.cidr, strings.TrimPrefix(a.field, "networkConfig."), a.cidr)
+			}
+		}
+	}
+
+	if domain := cfg.NetworkConfig.DNSDomain; domain != "" && !dnsDomainRe.MatchString(domain) {
+		add("networkConfig.dnsDomain", "must be a lowercase DNS name such as %q, got %q", DefaultDNSDomain, domain)
+	}
+
+	h, err := hostnet.New()
+	if err != nil {
+		add("networkConfig", "cannot check host routes: %v", err)
+		return
+	}
+	defer h.Close()
+	routes, err := h.Routes()
+	if err != nil {
+		add("networkConfig", "cannot check host routes: %v", err)
+		return
+	}
+	for _, n := range networks {
+		for _, r := range routes {
+			if r.Link == bridgeName(cfg.Name) || !cidrsOverlap(n.cidr, r.Dst) {
+				continue
+			}
+			via := ""
+			if r.Link != "" {
+				via = " via " + r.Link
+			}
+			add(n.field, "%s overlaps host route %s%s", n.cidr, r.Dst, via)
+		}
+	}
+}
+
+// cidrsOverlap reports whether two networks share addresses. Networks of
+// different families never do.
+func cidrsOverlap(a, b *net.IPNet) bool {
+	if (a.IP.To4() == nil) != (b.IP.To4() == nil) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// natTableName returns the name of the nftables table holding the
+// cluster's masquerade rule
+func (c *Cluster) natTableName() string {
+	return fmt.Sprintf("fck8s-%s", c.Config.Name)
+}
+
+// setupHostNetwork creates the cluster bridge with the gateway address,
+// enables forwarding and masquerades traffic leaving the node subnet
+func (c *Cluster) setupHostNetwork() error {
+	_, subnet, err := net.ParseCIDR(c.Config.NetworkConfig.SubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", c.Config.NetworkConfig.SubnetCIDR, err)
+	}
+	gateway := &net.IPNet{IP: net.ParseIP(c.Config.NetworkConfig.Gateway), Mask: subnet.Mask}
+
+	h, err := hostnet.New()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if err := c.record(effectBridge, "", c.bridgeName(), ""); err != nil {
+		return err
+	}
+	if err := h.EnsureBridge(c.bridgeName(), gateway); err != nil {
+		return err
+	}
+	// Forwarding is left on by rollbacks, as other users of the host may
+	// rely on it
+	if err := h.EnableForwarding(subnet); err != nil {
+		return err
+	}
+	if err := c.record(effectNAT, "", c.natTableName(), ""); err != nil {
+		return err
+	}
+	return h.EnsureMasquerade(c.natTableName(), subnet)
+}
+
+// createTap creates the TAP device of the node, attached to the cluster
+// bridge, and returns its name
+func (c *Cluster) createTap(node *Node) (string, error) {
+	tapName := nodeTapName(c.Config.Name, node.ID)
+
+	h, err := hostnet.New()
+	if err != nil {
+		return "", err
+	}
+	defer h.Close()
+
+	if err := c.record(effectTap, node.ID, tapName, ""); err != nil {
+		return "", err
+	}
+	if err := h.EnsureTap(tapName, hostnet.TapOptions{Bridge: c.bridgeName()}); err != nil {
+		return "", err
+	}
+	return tapName, nil
+}
+
+// netnsName returns the name of the network namespace of a jailed node
+func (c *Cluster) netnsName(node *Node) string {
+	return fmt.Sprintf("fck8s-%s", node.ID)
+}
+
+// netnsPath returns the path of the network namespace of a jailed node
+func (c *Cluster) netnsPath(node *Node) string {
+	return hostnet.NamespacePath(c.netnsName(node))
+}
+
+// vethName returns the name of the host end of the veth pair joining the
+// namespace of a jailed node to the cluster bridge
+func (c *Cluster) vethName(node *Node) string {
+	return fmt.Sprintf("vt%s%s", interfaceTag(c.Config.Name), nodeTag(c.Config.Name, node.ID))
+}
+
+// createJailedTap creates the network namespace of a jailed node and, inside
+// it, a TAP device owned by the node user. A bridge in the namespace joins
+// the TAP device to the cluster bridge through a veth pair, so the node sits
+// on the cluster subnet like any other.
+func (c *Cluster) createJailedTap(node *Node) (string, error) {
+	tapName := nodeTapName(c.Config.Name, node.ID)
+	namespace := c.netnsName(node)
+
+	// The TAP device lives in the namespace and goes away with it
+	if err := c.record(effectNetns, node.ID, namespace, ""); err != nil {
+		return "", err
+	}
+	if err := hostnet.EnsureNamespace(namespace); err != nil {
+		return "", err
+	}
+
+	h, err := hostnet.New()
+	if err != nil {
+		return "", err
+	}
+	defer h.Close()
+
+	if err := c.record(effectVeth, node.ID, c.vethName(node), ""); err != nil {
+		return "", err
+	}
+	if err := h.EnsureVeth(c.vethName(node), c.bridgeName(), "eth0", namespace); err != nil {
+		return "", err
+	}
+
+	ns, err := hostnet.OpenNamespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	defer ns.Close()
+
+	if err := ns.EnsureBridge("br0", nil); err != nil {
+		return "", err
+	}
+	if err := ns.AttachToBridge("eth0", "br0"); err != nil {
+		return "", err
+	}
+	opts := hostnet.TapOptions{Owner: uint32(node.UID), Group: uint32(node.GID), Bridge: "br0"}
+	if err := ns.EnsureTap(tapName, opts); err != nil {
+		return "", err
+	}
+	return tapName, nil
+}
+
+// teardownHostNetwork removes the TAP devices, network namespaces, bridge and
+// NAT table of the cluster. Resources that are already gone are skipped.
+func (c *Cluster) teardownHostNetwork() error {
+	h, err := hostnet.New()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	var errs []error
+	for _, node := range c.Nodes {
+		errs = append(errs, c.teardownNodeNetwork(h, node))
+	}
+	errs = append(errs, h.DeleteLink(c.bridgeName()))
+	errs = append(errs, h.DeleteMasquerade(c.natTableName()))
+
+	return errors.Join(errs...)
+}
+
+// teardownNodeNetwork removes the TAP device of the node and, for a jailed
+// node, its veth pair and network namespace
+func (c *Cluster) teardownNodeNetwork(h *hostnet.Host, node *Node) error {
+	// Nodes keep the name their TAP device was created with
+	errs := []error{h.DeleteLink(pick(node.TapName, nodeTapName(c.Config.Name, node.ID)))}
+	if c.Config.Jailer != nil {
+		errs = append(errs, h.DeleteLink(c.vethName(node)))
+		errs = append(errs, hostnet.DeleteNamespace(c.netnsName(node)))
+	}
+	return errors.Join(errs...)
+}
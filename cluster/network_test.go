@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestInterfaceNames(t *testing.T) {
+	for _, name := range []string{"a", "dev", "staging-cluster-with-a-long-name"} {
+		tag := interfaceTag(name)
+		tests := []struct {
+			nodeID string
+			want   string
+		}{
+			{name + "-ms", "tap" + tag + "m"},
+			{name + "-ms-2", "tap" + tag + "m2"},
+			{name + "-wk-0", "tap" + tag + "w0"},
+			{name + "-wk-12345", "tap" + tag + "w12345"},
+		}
+		for _, tt := range tests {
+			got := nodeTapName(name, tt.nodeID)
+			if got != tt.want {
+				t.Errorf("nodeTapName(%s, %s) = %s, want %s", name, tt.nodeID, got, tt.want)
+			}
+			if len(got) > maxTapNameLen {
+				t.Errorf("nodeTapName(%s, %s) = %s is longer than %d characters", name, tt.nodeID, got, maxTapNameLen)
+			}
+		}
+
+		if br := bridgeName(name); len(br) > maxTapNameLen || !strings.HasPrefix(br, "br-") {
+			t.Errorf("bridgeName(%s) = %s", name, br)
+		}
+	}
+
+	if bridgeName("dev") != "br-dev" {
+		t.Errorf("bridgeName(dev) = %s, want br-dev", bridgeName("dev"))
+	}
+	if interfaceTag("dev") == interfaceTag("prod") {
+		t.Error("clusters dev and prod share an interface tag")
+	}
+}
+
+func TestValidateTagLikeName(t *testing.T) {
+	// A cluster named after the tag of a cluster with a long name would get
+	// its bridge
+	long := "staging-cluster-with-a-long-name"
+	if bridgeName(interfaceTag(long)) != bridgeName(long) {
+		t.Fatalf("bridgeName(%s) = %s, expected the hashed form", long, bridgeName(long))
+	}
+
+	for name, wantErr := range map[string]bool{
+		interfaceTag(long): true,
+		"abc123":           true,
+		"abc12":            false,
+		"abc1234":          false,
+		"abcdeg":           false,
+	} {
+		var nameErr bool
+		cfg := ClusterConfig{Name: name}
+		if err, ok := cfg.Validate().(ValidationError); ok {
+			for _, fe := range err {
+				nameErr = nameErr || fe.Field == "name"
+			}
+		}
+		if nameErr != wantErr {
+			t.Errorf("Validate of cluster %s: name rejected = %v, want %v", name, nameErr, wantErr)
+		}
+	}
+}
+
+func TestValidateTapNames(t *testing.T) {
+	cfg := ClusterConfig{
+		Name:  "staging-cluster-with-a-long-name",
+		Pools: []NodePool{{Name: "worker", Role: "worker", Count: 100000}},
+	}
+	var tapErr bool
+	if err, ok := cfg.Validate().(ValidationError); ok {
+		for _, fe := range err {
+			if fe.Field == "name" {
+				t.Errorf("long cluster name rejected: %s", fe.Message)
+			}
+			if fe.Field == "nodeCount" && strings.Contains(fe.Message, "TAP device") {
+				tapErr = true
+			}
+		}
+	}
+	if !tapErr {
+		t.Error("Validate accepted a TAP device name over the kernel limit")
+	}
+
+	cfg.Pools[0].Count = 99999
+	if err, ok := cfg.Validate().(ValidationError); ok {
+		for _, fe := range err {
+			if strings.Contains(fe.Message, "TAP device") {
+				t.Errorf("Validate rejected %d nodes: %s", cfg.Pools[0].Count, fe.Message)
+			}
+		}
+	}
+}
+
+func TestCIDRsOverlap(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"nested", "10.0.0.0/8", "10.1.0.0/16", true},
+		{"nested reversed", "10.1.0.0/16", "10.0.0.0/8", true},
+		{"identical", "10.96.0.0/12", "10.96.0.0/12", true},
+		{"single address inside", "192.168.1.0/24", "192.168.1.7/32", true},
+		{"adjacent", "10.0.0.0/24", "10.0.1.0/24", false},
+		{"adjacent reversed", "10.0.1.0/24", "10.0.0.0/24", false},
+		{"disjoint", "10.244.0.0/16", "172.16.0.0/12", false},
+		{"ipv6 nested", "fd00::/8", "fd00:1::/64", true},
+		{"different families", "0.0.0.0/0", "::/0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, a, err := net.ParseCIDR(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, b, err := net.ParseCIDR(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cidrsOverlap(a, b); got != tt.want {
+				t.Errorf("cidrsOverlap(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"firecracker-k8s/console"
+)
+
+// Readiness stages, in the order a node passes them
+const (
+	StageAPI     = "api"     // the Firecracker API reports the VM running
+	StageConsole = "console" // the guest printed a login prompt on its serial console
+	StageTCP     = "tcp"     // port 22 accepts connections
+	StageSSH     = "ssh"     // the cluster key logs in
+	StageKubelet = "kubelet" // the kubelet health endpoint answers, after kubeadm init or join
+)
+
+// bootStages are probed as soon as a node is started
+var bootStages = []string{StageAPI, StageConsole, StageTCP, StageSSH}
+
+// Default readiness timeouts
+var defaultStageTimeouts = map[string]time.Duration{
+	StageAPI:     10 * time.Second,
+	StageConsole: 2 * time.Minute,
+	StageTCP:     time.Minute,
+	StageSSH:     time.Minute,
+	StageKubelet: 5 * time.Minute,
+}
+
+// Duration is a time.Duration written as a string such as "90s" or "2m"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"90s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ReadinessConfig controls how long each readiness stage may take. Zero
+// values take the defaults.
+type ReadinessConfig struct {
+	APITimeout     Duration `json:"apiTimeout,omitempty"`
+	ConsoleTimeout Duration `json:"consoleTimeout,omitempty"`
+	TCPTimeout     Duration `json:"tcpTimeout,omitempty"`
+	SSHTimeout     Duration `json:"sshTimeout,omitempty"`
+	KubeletTimeout Duration `json:"kubeletTimeout,omitempty"`
+	Interval       Duration `json:"interval,omitempty"` // between probe attempts; 1s by default
+	Skip           []string `json:"skip,omitempty"`     // stages not probed, e.g. console for guests without a getty on ttyS0
+}
+
+// timeout returns the timeout of the stage
+func (r ReadinessConfig) timeout(stage string) time.Duration {
+	configured := map[string]Duration{
+		StageAPI:     r.APITimeout,
+		StageConsole: r.ConsoleTimeout,
+		StageTCP:     r.TCPTimeout,
+		StageSSH:     r.SSHTimeout,
+		StageKubelet: r.KubeletTimeout,
+	}
+	return pick(time.Duration(configured[stage]), defaultStageTimeouts[stage])
+}
+
+func (r ReadinessConfig) skipped(stage string) bool {
+	for _, s := range r.Skip {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the readiness settings and reports problems through add
+func (r ReadinessConfig) validate(add func(field, format string, args ...interface{})) {
+	timeouts := []struct {
+		field string
+		value Duration
+	}{
+		{"apiTimeout", r.APITimeout},
+		{"consoleTimeout", r.ConsoleTimeout},
+		{"tcpTimeout", r.TCPTimeout},
+		{"sshTimeout", r.SSHTimeout},
+		{"kubeletTimeout", r.KubeletTimeout},
+		{"interval", r.Interval},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			add("readiness."+t.field, "must not be negative, got %s", time.Duration(t.value))
+		}
+	}
+	for i, stage := range r.Skip {
+		if _, ok := defaultStageTimeouts[stage]; !ok {
+			add(fmt.Sprintf("readiness.skip[%d]", i), "unknown stage %q", stage)
+		}
+	}
+}
+
+// BootEvent records how a node went through one readiness stage
+type BootEvent struct {
+	Stage    string        `json:"stage"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// waitReady probes the stages of the node in order, each until it passes or
+// its timeout expires, and records them in the node timeline. It stops at
+// the first stage that fails or when the cluster context is cancelled.
+func (c *Cluster) waitReady(node *Node, stages ...string) error {
+	interval := pick(time.Duration(c.Config.Readiness.Interval), time.Second)
+
+	for _, stage := range stages {
+		if c.Config.Readiness.skipped(stage) {
+			continue
+		}
+
+		timeout := c.Config.Readiness.timeout(stage)
+		ctx, cancel := context.WithTimeout(c.ctx, timeout)
+		start := time.Now()
+		err := poll(ctx, interval, func(ctx context.Context) error {
+			return c.probe(ctx, node, stage)
+		})
+		cancel()
+
+		event := BootEvent{Stage: stage, Start: start, Duration: time.Since(start)}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		node.Timeline = append(node.Timeline, event)
+
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return c.ctx.Err()
+			}
+			return fmt.Errorf("node %s not ready: stage %s failed after %s: %v", node.ID, stage, timeout, err)
+		}
+	}
+	return nil
+}
+
+// poll runs probe every interval until it succeeds or ctx is done, and then
+// returns the error of the last attempt
+func poll(ctx context.Context, interval time.Duration, probe func(context.Context) error) error {
+	for {
+		err := probe(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probe checks one readiness stage of the node once
+func (c *Cluster) probe(ctx context.Context, node *Node, stage string) error {
+	switch stage {
+	case StageAPI:
+		if node.Machine == nil {
+			return fmt.Errorf("no machine")
+		}
+		info, err := node.Machine.DescribeInstanceInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if info.State == nil || *info.State != "Running" {
+			return fmt.Errorf("instance is not running yet")
+		}
+		return nil
+
+	case StageConsole:
+		return c.probeConsole(ctx, node)
+
+	case StageTCP:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(node.IP, "22"))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case StageSSH:
+		// Probe SSH itself, without the guest agent fallback of run
+		code, err := c.execSSH(ctx, node, "true", nil, io.Discard, io.Discard)
+		if err == nil && code != 0 {
+			err = fmt.Errorf("exit status %d", code)
+		}
+		return err
+
+	case StageKubelet:
+		_, err := c.run(ctx, node, "curl -sf http://127.0.0.1:10248/healthz", nil, nil)
+		return err
+
+	default:
+		return fmt.Errorf("unknown readiness stage %q", stage)
+	}
+}
+
+// probeConsole looks for a login prompt in what the node printed on its
+// serial console since it was booted
+func (c *Cluster) probeConsole(ctx context.Context, node *Node) error {
+	data, err := console.Tail(ctx, consoleSocketPath(node))
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(data, []byte("login:")) {
+		return fmt.Errorf("no login prompt on the serial console yet")
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firecracker-k8s/hostnet"
+)
+
+// drainTimeout bounds kubectl drain by default
+const drainTimeout = 5 * time.Minute
+
+// AddWorkers boots n new workers in the first worker pool and joins them to
+// the cluster with a fresh join token. They get addresses, MAC addresses and
+// TAP devices the way the initial nodes did. If any of them fails to come up,
+// all of them are removed again.
+func (c *Cluster) AddWorkers(n int) ([]*Node, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("at least 1 worker must be added, got %d", n)
+	}
+	if _, err := c.runningMaster(); err != nil {
+		return nil, err
+	}
+
+	ipam, err := OpenIPAM(c.Config.Name, c.Config.NetworkConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.ipam = ipam
+
+	pool, err := c.workerPool()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := c.newWorkers(*pool, n)
+	if err != nil {
+		return nil, err
+	}
+	c.Nodes = append(c.Nodes, nodes...)
+	pool.Count += n
+	c.Config.NodeCount += n
+
+	fail := func(err error) ([]*Node, error) {
+		for _, node := range nodes {
+			if rerr := c.removeNode(node); rerr != nil {
+				log.Printf("Error removing node %s: %v", node.ID, rerr)
+			}
+		}
+		if serr := c.SaveState(); serr != nil {
+			log.Printf("Error saving state of cluster %s: %v", c.Config.Name, serr)
+		}
+		return nil, err
+	}
+
+	if err := c.assignMACs(); err != nil {
+		return fail(err)
+	}
+	if err := c.renderNodeBootArgs(nodes); err != nil {
+		return fail(err)
+	}
+	if c.Config.Jailer != nil {
+		if err := c.assignJailIDs(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := c.SaveState(); err != nil {
+		return fail(err)
+	}
+	if err := c.setupHostNetwork(); err != nil {
+		return fail(fmt.Errorf("failed to set up host network: %v", err))
+	}
+
+	// New workers find the join command in their metadata when they boot
+	if _, err := c.RotateJoinToken(c.ctx); err != nil {
+		return fail(fmt.Errorf("failed to create join token: %v", err))
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(nodes))
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			if err := c.provisionNode(n); err != nil {
+				errCh <- fmt.Errorf("failed to provision node %s: %v", n.ID, err)
+			}
+		}(node)
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return fail(err)
+	}
+
+	for _, node := range nodes {
+		if err := c.joinWorker(node); err != nil {
+			return fail(err)
+		}
+	}
+
+	return nodes, c.SaveState()
+}
+
+// workerPool returns the pool new workers are added to: the first worker
+// pool, or a new one with the cluster-wide settings when there is none
+func (c *Cluster) workerPool() (*NodePool, error) {
+	for i := range c.Config.Pools {
+		if c.Config.Pools[i].Role == "worker" {
+			return &c.Config.Pools[i], nil
+		}
+	}
+
+	// Settings only given per pool are taken from the first one
+	base := c.Config.Pools[0]
+	pool := NodePool{
+		Name:       "worker",
+		Role:       "worker",
+		VCPUCount:  pick(c.Config.VCPUCount, base.VCPUCount),
+		MemSizeMB:  pick(c.Config.MemSizeMB, base.MemSizeMB),
+		RootDrive:  pick(c.Config.RootDrive, base.RootDrive),
+		KernelPath: pick(c.Config.KernelPath, base.KernelPath),
+		InitrdPath: pick(c.Config.InitrdPath, base.InitrdPath),
+		BootArgs:   pick(c.Config.BootArgs, base.BootArgs),
+		SSHUser:    pick(c.Config.SSHUser, base.SSHUser),
+	}
+	for _, p := range c.Config.Pools {
+		if p.Name == pool.Name {
+			return nil, fmt.Errorf("cluster %s has no worker pool and pool %q is taken", c.Config.Name, pool.Name)
+		}
+	}
+	c.Config.Pools = append(c.Config.Pools, pool)
+	return &c.Config.Pools[len(c.Config.Pools)-1], nil
+}
+
+// newWorkers builds n workers of the pool, numbered after the existing
+// ones, and leases an address for each
+func (c *Cluster) newWorkers(pool NodePool, n int) ([]*Node, error) {
+	prefix := fmt.Sprintf("%s-wk-", c.Config.Name)
+	next := 0
+	for _, node := range c.Nodes {
+		if !strings.HasPrefix(node.ID, prefix) {
+			continue
+		}
+		if i, err := strconv.Atoi(strings.TrimPrefix(node.ID, prefix)); err == nil && i >= next {
+			next = i + 1
+		}
+	}
+	if tap := nodeTapName(c.Config.Name, fmt.Sprintf("%s%d", prefix, next+n-1)); len(tap) > maxTapNameLen {
+		return nil, fmt.Errorf("TAP device %q would exceed %d characters", tap, maxTapNameLen)
+	}
+
+	var nodes []*Node
+	for i := next; i < next+n; i++ {
+		node := newPoolNode(pool)
+		node.ID = fmt.Sprintf("%s%d", prefix, i)
+		node.RootPath = filepath.Join(clusterDir(c.Config.Name), fmt.Sprintf("worker-%d", i))
+
+		if err := c.record(effectLease, node.ID, node.ID, ""); err != nil {
+			return nil, err
+		}
+		ip, err := c.ipam.Allocate(node.ID)
+		if err != nil {
+			for _, n := range nodes {
+				c.ipam.Release(n.ID)
+			}
+			return nil, fmt.Errorf("failed to allocate an address for node %s: %v", node.ID, err)
+		}
+		node.IP = ip.String()
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// RemoveWorker takes a worker out of the cluster: Kubernetes cordons, drains
+// and deletes the node, then its VM is shut down and its disk, address and
+// host devices are released. The worker is kept if it cannot be drained.
+func (c *Cluster) RemoveWorker(id string) error {
+	node, err := c.Node(id)
+	if err != nil {
+		return err
+	}
+	if node.Role != "worker" {
+		return fmt.Errorf("node %s is a %s, only workers can be removed", id, node.Role)
+	}
+	master, err := c.runningMaster()
+	if err != nil {
+		return err
+	}
+
+	if err := c.drainNode(master, node, time.Duration(pick(c.Config.Shutdown.DrainTimeout, Duration(drainTimeout)))); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, time.Minute)
+	defer cancel()
+	if err := c.kubectl(ctx, master, "delete node --ignore-not-found "+shellQuote(id)); err != nil {
+		return fmt.Errorf("failed to delete node %s from Kubernetes: %v", id, err)
+	}
+
+	if c.ipam == nil {
+		if c.ipam, err = OpenIPAM(c.Config.Name, c.Config.NetworkConfig); err != nil {
+			return err
+		}
+	}
+	err = c.removeNode(node)
+	if serr := c.SaveState(); serr != nil {
+		return errors.Join(err, serr)
+	}
+	return err
+}
+
+// removeNode shuts the node down, releases its jail, disk, host devices,
+// address and pinned host key, deletes its directory and drops it from the
+// cluster and its pool
+func (c *Cluster) removeNode(node *Node) error {
+	var errs []error
+	if r := c.shutdownNode(node, c.Config.Shutdown); r.Error != "" {
+		errs = append(errs, fmt.Errorf("failed to shut down node: %s", r.Error))
+	}
+	c.ssh.close(node.ID)
+
+	h, err := hostnet.New()
+	if err == nil {
+		errs = append(errs, c.teardownNodeNetwork(h, node))
+		h.Close()
+	} else {
+		errs = append(errs, err)
+	}
+	// The next node leased the address comes with another host key
+	if node.IP != "" {
+		errs = append(errs, c.forgetHostKey(node.IP))
+	}
+	if c.ipam != nil {
+		errs = append(errs, c.ipam.Release(node.ID))
+	}
+	if err := os.RemoveAll(node.RootPath); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove node directory: %v", err))
+	}
+	if err := errors.Join(errs...); err == nil {
+		errs = append(errs, c.forget(node.ID))
+	}
+
+	for i, n := range c.Nodes {
+		if n == node {
+			c.Nodes = append(c.Nodes[:i], c.Nodes[i+1:]...)
+			c.Config.NodeCount--
+			break
+		}
+	}
+	for i := range c.Config.Pools {
+		if c.Config.Pools[i].Name != node.Pool {
+			continue
+		}
+		c.Config.Pools[i].Count--
+		if c.Config.Pools[i].Count == 0 {
+			c.Config.Pools = append(c.Config.Pools[:i], c.Config.Pools[i+1:]...)
+		}
+		break
+	}
+
+	return errors.Join(errs...)
+}
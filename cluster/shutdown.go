@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// How a node was brought down, in the order they are tried
+const (
+	StoppedByGuest    = "guest"       // the guest powered off after Ctrl+Alt+Del
+	StoppedBySIGTERM  = "sigterm"     // the VMM exited on SIGTERM
+	StoppedBySIGKILL  = "sigkill"     // the VMM had to be killed
+	StoppedNotRunning = "not-running" // the VMM was already gone
+)
+
+// Shutdown defaults
+const (
+	defaultGracePeriod = 30 * time.Second
+	defaultKillTimeout = 10 * time.Second
+)
+
+// ShutdownConfig controls how nodes are shut down. Zero values take the
+// defaults.
+type ShutdownConfig struct {
+	Drain        bool     `json:"drain,omitempty"`        // drain workers in Kubernetes before they are shut down
+	DrainTimeout Duration `json:"drainTimeout,omitempty"` // per worker; 5m by default
+	GracePeriod  Duration `json:"gracePeriod,omitempty"`  // wait for the guest to power off after Ctrl+Alt+Del; 30s by default
+	KillTimeout  Duration `json:"killTimeout,omitempty"`  // wait for the VMM to exit on SIGTERM before SIGKILL; 10s by default
+}
+
+// validate checks the shutdown settings and reports problems through add
+func (sc ShutdownConfig) validate(add func(field, format string, args ...interface{})) {
+	for field, d := range map[string]Duration{
+		"shutdown.drainTimeout": sc.DrainTimeout,
+		"shutdown.gracePeriod":  sc.GracePeriod,
+		"shutdown.killTimeout":  sc.KillTimeout,
+	} {
+		if d < 0 {
+			add(field, "must not be negative, got %s", time.Duration(d))
+		}
+	}
+}
+
+// NodeShutdown is the outcome of shutting down one node
+type NodeShutdown struct {
+	Node      string        `json:"node"`
+	Drained   bool          `json:"drained,omitempty"`
+	StoppedBy string        `json:"stoppedBy"` // guest, sigterm, sigkill or not-running
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"` // what went wrong; the node may still be stopped
+}
+
+// ShutdownReport lists the outcome of shutting down every node
+type ShutdownReport struct {
+	Nodes []NodeShutdown `json:"nodes"`
+}
+
+// Clean reports whether every node was shut down without errors
+func (r *ShutdownReport) Clean() bool {
+	for _, n := range r.Nodes {
+		if n.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdownNodes drains the workers among nodes if asked to, while the
+// control plane is still up, then shuts all of them down in parallel
+func (c *Cluster) shutdownNodes(nodes []*Node, cfg ShutdownConfig) *ShutdownReport {
+	report := &ShutdownReport{Nodes: make([]NodeShutdown, len(nodes))}
+	for i, node := range nodes {
+		report.Nodes[i].Node = node.ID
+	}
+
+	if cfg.Drain {
+		master, masterErr := c.runningMaster()
+		for i, node := range nodes {
+			if node.Role != "worker" || node.Status != NodeRunning {
+				continue
+			}
+			err := masterErr
+			if err == nil {
+				err = c.drainNode(master, node, time.Duration(pick(cfg.DrainTimeout, Duration(drainTimeout))))
+			}
+			if err != nil {
+				report.Nodes[i].Error = err.Error()
+				continue
+			}
+			report.Nodes[i].Drained = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(r *NodeShutdown, node *Node) {
+			defer wg.Done()
+			result := c.shutdownNode(node, cfg)
+			result.Drained = r.Drained
+			switch {
+			case r.Error == "":
+			case result.Error == "":
+				result.Error = r.Error
+			default:
+				result.Error = r.Error + "; " + result.Error
+			}
+			*r = result
+		}(&report.Nodes[i], node)
+	}
+	wg.Wait()
+	return report
+}
+
+// drainNode cordons the node and evicts its pods. The node stays cordoned
+// until Start uncordons it.
+func (c *Cluster) drainNode(master, node *Node, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+time.Minute)
+	defer cancel()
+
+	node.Cordoned = true
+	if err := c.kubectl(ctx, master, "cordon "+shellQuote(node.ID)); err != nil {
+		return fmt.Errorf("failed to cordon node %s: %v", node.ID, err)
+	}
+	drain := fmt.Sprintf("drain %s --ignore-daemonsets --delete-emptydir-data --force --timeout=%s", shellQuote(node.ID), timeout)
+	if err := c.kubectl(ctx, master, drain); err != nil {
+		return fmt.Errorf("failed to drain node %s: %v", node.ID, err)
+	}
+	return nil
+}
+
+// uncordonNodes lets the nodes drained by Stop take pods again, retrying
+// while the API server comes back up
+func (c *Cluster) uncordonNodes() error {
+	var master *Node
+	for _, node := range c.Nodes {
+		if !node.Cordoned {
+			continue
+		}
+		if master == nil {
+			var err error
+			if master, err = c.runningMaster(); err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, 5*time.Minute)
+		err := poll(ctx, 5*time.Second, func(ctx context.Context) error {
+			return c.kubectl(ctx, master, "uncordon "+shellQuote(node.ID))
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to uncordon node %s: %v", node.ID, err)
+		}
+		node.Cordoned = false
+	}
+	return nil
+}
+
+// shutdownNode brings the VMM of the node down: Ctrl+Alt+Del lets the guest
+// power off, then SIGTERM and finally SIGKILL are sent when it takes too
+// long. The API socket, jail and root disk attachment are released whatever
+// happened. It does not use the cluster context, which may be cancelled.
+func (c *Cluster) shutdownNode(node *Node, cfg ShutdownConfig) NodeShutdown {
+	start := time.Now()
+	result := NodeShutdown{Node: node.ID, StoppedBy: StoppedNotRunning}
+	c.ssh.close(node.ID)
+
+	var errs []error
+	if c.vmmAlive(node.ID)(node.PID) {
+		stoppedBy, err := c.powerOff(node, cfg)
+		result.StoppedBy = stoppedBy
+		if err != nil {
+			// The node is still running; keep it so it can be stopped again
+			result.Error = err.Error()
+			result.Duration = time.Since(start)
+			return result
+		}
+	}
+
+	node.Machine = nil
+	node.PID = 0
+	node.Status = NodeStopped
+	if node.SocketPath != "" {
+		if err := os.Remove(node.SocketPath); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove API socket: %v", err))
+		}
+	}
+	errs = append(errs, c.teardownJail(node), detachRootDisk(node))
+
+	if err := errors.Join(errs...); err != nil {
+		result.Error = err.Error()
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// powerOff stops the running VMM of the node and returns how it went down
+func (c *Cluster) powerOff(node *Node, cfg ShutdownConfig) (string, error) {
+	return powerOff(node.PID, c.vmmAlive(node.ID), node.SocketPath, node.Machine, cfg)
+}
+
+// StopVMM brings down a Firecracker process that is not a node of a
+// cluster the way nodes are: Ctrl+Alt+Del through its API socket, then
+// SIGTERM and SIGKILL. Such VMs are not Kubernetes nodes, so cfg.Drain is
+// ignored. The process must run the firecracker binary from PATH. The
+// socket is removed once the process is gone. It returns how the process
+// went down.
+func StopVMM(pid int, socketPath string, cfg ShutdownConfig) (string, error) {
+	alive := func(pid int) bool { return firecrackerAlive(pid, "", firecrackerBinary) }
+	stoppedBy := StoppedNotRunning
+	if alive(pid) {
+		var err error
+		if stoppedBy, err = powerOff(pid, alive, socketPath, nil, cfg); err != nil {
+			return stoppedBy, err
+		}
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return stoppedBy, fmt.Errorf("failed to remove API socket: %v", err)
+	}
+	return stoppedBy, nil
+}
+
+// powerOff stops the running VMM pid, served by the machine m or the API
+// socket, and returns how it went down. alive tells whether pid is still
+// the VMM.
+func powerOff(pid int, alive func(int) bool, socketPath string, m *firecracker.Machine, cfg ShutdownConfig) (string, error) {
+	if err := sendCtrlAltDel(socketPath, m); err == nil {
+		if waitForExit(pid, alive, time.Duration(pick(cfg.GracePeriod, Duration(defaultGracePeriod)))) {
+			return StoppedByGuest, nil
+		}
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return StoppedBySIGTERM, fmt.Errorf("failed to stop firecracker process %d: %v", pid, err)
+	}
+	if waitForExit(pid, alive, time.Duration(pick(cfg.KillTimeout, Duration(defaultKillTimeout)))) {
+		return StoppedBySIGTERM, nil
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return StoppedBySIGKILL, fmt.Errorf("failed to kill firecracker process %d: %v", pid, err)
+	}
+	if !waitForExit(pid, alive, 5*time.Second) {
+		return StoppedBySIGKILL, fmt.Errorf("firecracker process %d did not exit after SIGKILL", pid)
+	}
+	return StoppedBySIGKILL, nil
+}
+
+// sendCtrlAltDel asks the guest to power off through the machine m, or a
+// new handle on the API socket when m is nil
+func sendCtrlAltDel(socketPath string, m *firecracker.Machine) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if m == nil {
+		var err error
+		m, err = firecracker.NewMachine(ctx, firecracker.Config{SocketPath: socketPath})
+		if err != nil {
+			return err
+		}
+	}
+	return m.Shutdown(ctx)
+}
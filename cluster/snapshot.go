@@ -0,0 +1,305 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Files of a snapshot
+const (
+	snapshotsDirName     = "snapshots"
+	snapshotManifestName = "manifest.json"
+	snapshotStateFile    = "vm.state"
+	snapshotMemoryFile   = "memory"
+)
+
+// SnapshotManifest describes a snapshot of every node of a cluster, taken
+// while all of them were paused
+type SnapshotManifest struct {
+	Name      string         `json:"name"`
+	Cluster   string         `json:"cluster"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Nodes     []NodeSnapshot `json:"nodes"`
+}
+
+// NodeSnapshot lists the files of the snapshot of one node, relative to the
+// snapshot directory
+type NodeSnapshot struct {
+	Node         string `json:"node"`
+	State        string `json:"state"`  // Firecracker VM state
+	Memory       string `json:"memory"` // guest memory
+	Disk         string `json:"disk"`   // copy of the root disk, or of its copy-on-write file
+	DiskProvider string `json:"diskProvider"`
+	MacAddress   string `json:"macAddress"`
+
+	statePath, memoryPath string // absolute, set when loading
+}
+
+// snapshotDir returns the directory of the named snapshot of the cluster
+func (c *Cluster) snapshotDir(name string) string {
+	return filepath.Join(clusterDir(c.Config.Name), snapshotsDirName, name)
+}
+
+// Snapshot pauses every node, writes a full snapshot of its memory and VM
+// state along with a copy of its root disk, and resumes the nodes. The
+// manifest is written last, so a snapshot without one is incomplete.
+func (c *Cluster) Snapshot(name string) (*SnapshotManifest, error) {
+	if !clusterNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	if c.Config.Jailer != nil {
+		return nil, fmt.Errorf("snapshots of jailed clusters are not supported")
+	}
+	for _, node := range c.Nodes {
+		if node.Status != NodeRunning || node.Machine == nil {
+			return nil, fmt.Errorf("node %s is not running", node.ID)
+		}
+	}
+
+	dir := c.snapshotDir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("snapshot %s of cluster %s already exists", name, c.Config.Name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	fail := func(err error) (*SnapshotManifest, error) {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// Pause every node before snapshotting any, so they all stop at the
+	// same point in time
+	var paused []*Node
+	defer func() {
+		for _, node := range paused {
+			if err := node.Machine.ResumeVM(context.Background()); err != nil {
+				log.Printf("Error resuming node %s: %v", node.ID, err)
+			}
+		}
+	}()
+	for _, node := range c.Nodes {
+		if err := node.Machine.PauseVM(c.ctx); err != nil {
+			return fail(fmt.Errorf("failed to pause node %s: %v", node.ID, err))
+		}
+		paused = append(paused, node)
+	}
+
+	manifest := &SnapshotManifest{
+		Name:      name,
+		Cluster:   c.Config.Name,
+		CreatedAt: time.Now().UTC(),
+		Nodes:     make([]NodeSnapshot, len(c.Nodes)),
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(c.Nodes))
+	for i, node := range c.Nodes {
+		wg.Add(1)
+		go func(ns *NodeSnapshot, node *Node) {
+			defer wg.Done()
+			if err := c.snapshotNode(dir, node, ns); err != nil {
+				errCh <- fmt.Errorf("failed to snapshot node %s: %v", node.ID, err)
+			}
+		}(&manifest.Nodes[i], node)
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return fail(err)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fail(fmt.Errorf("failed to encode snapshot manifest: %v", err))
+	}
+	if err := os.WriteFile(filepath.Join(dir, snapshotManifestName), data, 0644); err != nil {
+		return fail(fmt.Errorf("failed to write snapshot manifest: %v", err))
+	}
+	return manifest, nil
+}
+
+// snapshotNode writes the snapshot of a paused node to its directory in the
+// snapshot and fills in ns
+func (c *Cluster) snapshotNode(dir string, node *Node, ns *NodeSnapshot) error {
+	if err := os.MkdirAll(filepath.Join(dir, node.ID), 0755); err != nil {
+		return err
+	}
+	disk := rootDiskFile(node)
+	*ns = NodeSnapshot{
+		Node:         node.ID,
+		State:        filepath.Join(node.ID, snapshotStateFile),
+		Memory:       filepath.Join(node.ID, snapshotMemoryFile),
+		Disk:         filepath.Join(node.ID, filepath.Base(disk)),
+		DiskProvider: node.DiskProvider,
+		MacAddress:   node.MacAddress,
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Minute)
+	defer cancel()
+	if err := node.Machine.CreateSnapshot(ctx, filepath.Join(dir, ns.Memory), filepath.Join(dir, ns.State)); err != nil {
+		return err
+	}
+
+	thaw, err := freezeRootDisk(node)
+	if err != nil {
+		return fmt.Errorf("failed to suspend root disk: %v", err)
+	}
+	err = cloneDisk(disk, filepath.Join(dir, ns.Disk))
+	if terr := thaw(); terr != nil {
+		return errors.Join(err, fmt.Errorf("failed to resume root disk: %v", terr))
+	}
+	return err
+}
+
+// ReadSnapshot reads the manifest of the named snapshot of the cluster
+func (c *Cluster) ReadSnapshot(name string) (*SnapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(c.snapshotDir(name), snapshotManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot %s of cluster %s not found", name, c.Config.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot manifest: %v", err)
+	}
+
+	var manifest SnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest of snapshot %s: %v", name, err)
+	}
+	return &manifest, nil
+}
+
+// Snapshots returns the complete snapshots of the cluster, oldest first
+func (c *Cluster) Snapshots() ([]*SnapshotManifest, error) {
+	entries, err := os.ReadDir(filepath.Join(clusterDir(c.Config.Name), snapshotsDirName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	var manifests []*SnapshotManifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifest, err := c.ReadSnapshot(entry.Name())
+		if err != nil {
+			continue // incomplete
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].CreatedAt.Before(manifests[j].CreatedAt)
+	})
+	return manifests, nil
+}
+
+// Restore brings every node back to the named snapshot: running VMs are
+// killed, the root disks are replaced with their copies and the VMs are
+// loaded paused, then resumed together. The guest clocks are set to the
+// host time, as they resume where the snapshot left them.
+func (c *Cluster) Restore(name string) error {
+	if c.Config.Jailer != nil {
+		return fmt.Errorf("snapshots of jailed clusters are not supported")
+	}
+	manifest, err := c.ReadSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	dir := c.snapshotDir(name)
+	snaps := make(map[string]*NodeSnapshot)
+	for i := range manifest.Nodes {
+		ns := &manifest.Nodes[i]
+		ns.statePath = filepath.Join(dir, ns.State)
+		ns.memoryPath = filepath.Join(dir, ns.Memory)
+		snaps[ns.Node] = ns
+	}
+	if len(snaps) != len(c.Nodes) {
+		return fmt.Errorf("snapshot %s has %d nodes, cluster %s has %d", name, len(snaps), c.Config.Name, len(c.Nodes))
+	}
+	for _, node := range c.Nodes {
+		ns, ok := snaps[node.ID]
+		if !ok {
+			return fmt.Errorf("snapshot %s has no node %s", name, node.ID)
+		}
+		if ns.DiskProvider != node.DiskProvider || ns.MacAddress != node.MacAddress {
+			return fmt.Errorf("node %s changed since snapshot %s was taken", node.ID, name)
+		}
+	}
+
+	fail := func(err error) error {
+		if saveErr := c.SaveState(); saveErr != nil {
+			log.Printf("Error saving state of cluster %s: %v", c.Config.Name, saveErr)
+		}
+		return err
+	}
+
+	// The current state of the nodes is thrown away, so there is no point
+	// in shutting them down cleanly
+	for _, node := range c.Nodes {
+		if err := terminate(strconv.Itoa(node.PID), c.vmmAlive(node.ID)); err != nil {
+			return fail(fmt.Errorf("failed to stop node %s: %v", node.ID, err))
+		}
+		if r := c.shutdownNode(node, c.Config.Shutdown); r.Error != "" {
+			return fail(fmt.Errorf("failed to clean up node %s: %s", node.ID, r.Error))
+		}
+	}
+
+	if err := c.setupHostNetwork(); err != nil {
+		return fail(fmt.Errorf("failed to set up host network: %v", err))
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(c.Nodes))
+	for _, node := range c.Nodes {
+		wg.Add(1)
+		go func(n *Node, ns *NodeSnapshot) {
+			defer wg.Done()
+			if err := cloneDisk(filepath.Join(dir, ns.Disk), rootDiskFile(n)); err != nil {
+				errCh <- fmt.Errorf("failed to restore disk of node %s: %v", n.ID, err)
+				return
+			}
+			if err := c.launchNode(n, ns); err != nil {
+				errCh <- fmt.Errorf("failed to restore node %s: %v", n.ID, err)
+			}
+		}(node, snaps[node.ID])
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return fail(err)
+	}
+
+	for _, node := range c.Nodes {
+		if err := node.Machine.ResumeVM(c.ctx); err != nil {
+			return fail(fmt.Errorf("failed to resume node %s: %v", node.ID, err))
+		}
+	}
+	for _, node := range c.Nodes {
+		if err := c.waitReady(node, StageSSH); err != nil {
+			return fail(err)
+		}
+		if _, err := c.run(c.ctx, node, fmt.Sprintf("date -u -s @%d", time.Now().Unix()), nil, nil); err != nil {
+			return fail(fmt.Errorf("failed to set clock of node %s: %v", node.ID, err))
+		}
+	}
+
+	if err := c.startLoadBalancer(); err != nil {
+		return fail(err)
+	}
+	if err := c.waitNodesReady(); err != nil {
+		return fail(err)
+	}
+	return c.SaveState()
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Spec file identifiers. The version is bumped whenever a field changes
+// meaning so old files are rejected instead of misread.
+const (
+	SpecAPIVersion = "firecracker-k8s/v1alpha1"
+	SpecKind       = "Cluster"
+)
+
+// ClusterSpec is the declarative file format for a cluster. It is read as
+// YAML, which also accepts JSON, and its spec section maps field for field
+// onto ClusterConfig.
+type ClusterSpec struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Spec       ClusterConfig `json:"spec"`
+}
+
+// LoadSpec reads and validates a cluster spec file
+func LoadSpec(path string) (ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ClusterConfig{}, fmt.Errorf("failed to read spec file: %v", err)
+	}
+
+	cfg, err := ParseSpec(data)
+	if err != nil {
+		return ClusterConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseSpec decodes and validates a cluster spec. Unknown fields are
+// rejected so typos do not silently fall back to defaults.
+func ParseSpec(data []byte) (ClusterConfig, error) {
+	var spec ClusterSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return ClusterConfig{}, fmt.Errorf("failed to parse spec: %v", err)
+	}
+
+	var errs ValidationError
+	if spec.APIVersion != SpecAPIVersion {
+		errs = append(errs, FieldError{Field: "apiVersion", Message: fmt.Sprintf("unsupported version %q, expected %q", spec.APIVersion, SpecAPIVersion)})
+	}
+	if spec.Kind != SpecKind {
+		errs = append(errs, FieldError{Field: "kind", Message: fmt.Sprintf("must be %q, got %q", SpecKind, spec.Kind)})
+	}
+
+	var verr ValidationError
+	if err := spec.Spec.Validate(); errors.As(err, &verr) {
+		errs = append(errs, verr.withPrefix("spec.")...)
+	}
+	if len(errs) > 0 {
+		return ClusterConfig{}, errs
+	}
+
+	return spec.Spec, nil
+}
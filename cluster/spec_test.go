@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const specHeader = `apiVersion: firecracker-k8s/v1alpha1
+kind: Cluster
+`
+
+const specBody = `spec:
+  name: dev
+  nodeCount: 1
+  vcpuCount: 1
+  memSizeMB: 1024
+  rootDrive: ./rootfs.ext4
+  networkConfig:
+    subnetCIDR: 172.31.250.0/24
+    gateway: 172.31.250.1
+`
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantField string // reported by a ValidationError
+		wantErr   string // in the error of a spec that does not parse
+	}{
+		{
+			name:    "unknown field",
+			spec:    specHeader + specBody + "  nodeCuont: 3\n",
+			wantErr: `unknown field "nodeCuont"`,
+		},
+		{
+			name:    "unknown top-level field",
+			spec:    specHeader + "metadata:\n  name: dev\n" + specBody,
+			wantErr: `unknown field "metadata"`,
+		},
+		{
+			name:      "wrong apiVersion",
+			spec:      strings.Replace(specHeader, "v1alpha1", "v1", 1) + specBody,
+			wantField: "apiVersion",
+		},
+		{
+			name:      "missing apiVersion",
+			spec:      "kind: Cluster\n" + specBody,
+			wantField: "apiVersion",
+		},
+		{
+			name:      "wrong kind",
+			spec:      strings.Replace(specHeader, "Cluster", "Deployment", 1) + specBody,
+			wantField: "kind",
+		},
+		{
+			name:      "spec fields are prefixed",
+			spec:      specHeader + strings.Replace(specBody, "name: dev", "name: Dev", 1),
+			wantField: "spec.name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSpec([]byte(tt.spec))
+			if err == nil {
+				t.Fatal("ParseSpec accepted the spec")
+			}
+			var verr ValidationError
+			isValidation := errors.As(err, &verr)
+			if tt.wantErr != "" {
+				if isValidation || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseSpec error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if !isValidation {
+				t.Fatalf("ParseSpec error = %v, want a ValidationError", err)
+			}
+			for _, fe := range verr {
+				if fe.Field == tt.wantField {
+					return
+				}
+			}
+			t.Errorf("ParseSpec error = %v, want one for %s", err, tt.wantField)
+		})
+	}
+}
+
+func TestParseSpecHeader(t *testing.T) {
+	// The rest of the spec may fail on this host, the missing kernel for
+	// one, but not the header
+	_, err := ParseSpec([]byte(specHeader + specBody))
+	var verr ValidationError
+	if err != nil && !errors.As(err, &verr) {
+		t.Fatalf("ParseSpec: %v", err)
+	}
+	for _, fe := range verr {
+		if fe.Field == "apiVersion" || fe.Field == "kind" || !strings.HasPrefix(fe.Field, "spec.") {
+			t.Errorf("ParseSpec rejected %s: %s", fe.Field, fe.Message)
+		}
+	}
+}
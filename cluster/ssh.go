@@ -0,0 +1,259 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsMu serialises updates of the known_hosts files, which are pinned
+// from the parallel node goroutines
+var knownHostsMu sync.Mutex
+
+// sshDir returns the directory holding the SSH key pair and known_hosts file
+// of the cluster
+func (c *Cluster) sshDir() string {
+	return filepath.Join(clusterDir(c.Config.Name), "ssh")
+}
+
+// SSHKeyPath returns the path of the private key the cluster logs in to its
+// nodes with
+func (c *Cluster) SSHKeyPath() string {
+	return filepath.Join(c.sshDir(), "id_ed25519")
+}
+
+// KnownHostsPath returns the path of the known_hosts file pinning the host
+// keys of the cluster's nodes
+func (c *Cluster) KnownHostsPath() string {
+	return filepath.Join(c.sshDir(), "known_hosts")
+}
+
+// ensureSSHKey generates the ed25519 key pair of the cluster unless it
+// already exists
+func (c *Cluster) ensureSSHKey() error {
+	if _, err := os.Stat(c.SSHKeyPath()); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(c.sshDir()); os.IsNotExist(err) {
+		if err := c.record(effectDir, "", c.sshDir(), ""); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(c.sshDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create SSH directory: %v", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate SSH key: %v", err)
+	}
+
+	comment := fmt.Sprintf("firecracker-k8s@%s", c.Config.Name)
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return fmt.Errorf("failed to encode SSH key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("failed to encode SSH public key: %v", err)
+	}
+	authorizedKey := fmt.Sprintf("%s %s\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))), comment)
+
+	if err := os.WriteFile(c.SSHKeyPath()+".pub", []byte(authorizedKey), 0644); err != nil {
+		return fmt.Errorf("failed to write SSH public key: %v", err)
+	}
+	if err := os.WriteFile(c.SSHKeyPath(), pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("failed to write SSH key: %v", err)
+	}
+	return nil
+}
+
+// installSSHKey adds the cluster public key to the authorized_keys of the
+// node user in the root filesystem mounted at root
+func (c *Cluster) installSSHKey(node *Node, root string) error {
+	authorizedKey, err := os.ReadFile(c.SSHKeyPath() + ".pub")
+	if err != nil {
+		return fmt.Errorf("failed to read SSH public key: %v", err)
+	}
+
+	uid, gid, home, err := lookupUser(filepath.Join(root, "etc", "passwd"), node.Username)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(root, home, ".ssh")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Join(home, ".ssh"), err)
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, "authorized_keys")
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !bytes.Contains(existing, bytes.TrimSpace(authorizedKey)) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open authorized_keys: %v", err)
+		}
+		_, err = f.Write(authorizedKey)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write authorized_keys: %v", err)
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupUser finds the UID, GID and home directory of user in a passwd file
+func lookupUser(passwd, user string) (int, int, string, error) {
+	f, err := os.Open(passwd)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("failed to read passwd of root disk: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 7 || fields[0] != user {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("invalid UID of user %s: %v", user, err)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("invalid GID of user %s: %v", user, err)
+		}
+		return uid, gid, fields[5], nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, "", err
+	}
+	return 0, 0, "", fmt.Errorf("user %s does not exist in the root disk", user)
+}
+
+// sshClientConfig returns the SSH client configuration used for the node:
+// the cluster key, and the host key pinned on first connect
+func (c *Cluster) sshClientConfig(node *Node) (*ssh.ClientConfig, error) {
+	key, err := os.ReadFile(c.SSHKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %v", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            node.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: c.pinHostKey(node),
+		Timeout:         5 * time.Second, // Set connection timeout
+	}, nil
+}
+
+// pinHostKey returns a host key callback that records the key of the node
+// in the cluster known_hosts file the first time it connects and rejects
+// any other key afterwards
+func (c *Cluster) pinHostKey(node *Node) ssh.HostKeyCallback {
+	path := c.KnownHostsPath()
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open known_hosts: %v", err)
+		}
+		defer f.Close()
+
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("failed to read known_hosts: %v", err)
+		}
+
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key of node %s does not match the key pinned in %s: %v", node.ID, path, err)
+		}
+
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return fmt.Errorf("failed to pin host key of node %s: %v", node.ID, err)
+		}
+		return nil
+	}
+}
+
+// forgetHostKey drops the host key pinned for the address from the cluster
+// known_hosts file, so the next node leased the address can pin its own
+func (c *Cluster) forgetHostKey(ip string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	path := c.KnownHostsPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read known_hosts: %v", err)
+	}
+
+	host := knownhosts.Normalize(net.JoinHostPort(ip, "22"))
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && slices.Contains(strings.Split(fields[0], ","), host) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if err := os.WriteFile(path+".tmp", []byte(strings.Join(kept, "")), 0600); err != nil {
+		return fmt.Errorf("failed to write known_hosts: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// dialSSH connects to the SSH server of the node
+func (c *Cluster) dialSSH(node *Node) (*ssh.Client, error) {
+	config, err := c.sshClientConfig(node)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(node.IP, "22"), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", node.IP, err)
+	}
+	return conn, nil
+}
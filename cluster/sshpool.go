@@ -0,0 +1,411 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"firecracker-k8s/agent"
+)
+
+// DefaultCommandTimeout bounds node commands whose context has no deadline
+const DefaultCommandTimeout = 10 * time.Minute
+
+// commandLogFile is the per-node log of every command run over SSH or the
+// guest agent
+const commandLogFile = "ssh.log"
+
+// CommandResult is the outcome of a command run on a node
+type CommandResult struct {
+	NodeID   string        `json:"nodeID"`
+	Command  string        `json:"command"`
+	Stdout   string        `json:"stdout"`
+	Stderr   string        `json:"stderr"`
+	ExitCode int           `json:"exitCode"` // -1 if the command did not exit
+	Duration time.Duration `json:"duration"`
+}
+
+// OutputFunc receives every line a node command writes, with stream set to
+// "stdout" or "stderr". It is called from the goroutines copying the
+// command output, so it must be safe for concurrent use.
+type OutputFunc func(nodeID, stream, line string)
+
+// sshPool keeps one SSH connection per node, shared by all the sessions run
+// on it
+type sshPool struct {
+	mu    sync.Mutex
+	conns map[string]*sshConn
+}
+
+// sshConn is the pooled connection of one node. Its lock only guards
+// dialing, so a slow node does not hold up the others.
+type sshConn struct {
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func newSSHPool() *sshPool {
+	return &sshPool{conns: make(map[string]*sshConn)}
+}
+
+// conn returns the pool entry of the node, creating it if needed
+func (p *sshPool) conn(nodeID string) *sshConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sc, ok := p.conns[nodeID]
+	if !ok {
+		sc = &sshConn{}
+		p.conns[nodeID] = sc
+	}
+	return sc
+}
+
+// get returns the pooled client, dialing one if there is none
+func (sc *sshConn) get(dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.client == nil {
+		client, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		sc.client = client
+	}
+	return sc.client, nil
+}
+
+// reset closes client and removes it from the pool unless it has already
+// been replaced
+func (sc *sshConn) reset(client *ssh.Client) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.client == client {
+		sc.client.Close()
+		sc.client = nil
+	}
+}
+
+// close closes the pooled connection of the node
+func (p *sshPool) close(nodeID string) {
+	p.mu.Lock()
+	sc, ok := p.conns[nodeID]
+	delete(p.conns, nodeID)
+	p.mu.Unlock()
+
+	if ok {
+		sc.mu.Lock()
+		if sc.client != nil {
+			sc.client.Close()
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// closeAll closes every pooled connection
+func (p *sshPool) closeAll() {
+	p.mu.Lock()
+	ids := make([]string, 0, len(p.conns))
+	for id := range p.conns {
+		ids = append(ids, id)
+	}
+	p.mu.Unlock()
+
+	for _, id := range ids {
+		p.close(id)
+	}
+}
+
+// newSession opens a session on the pooled connection of the node. A
+// connection that has gone stale, for example because the node rebooted, is
+// replaced once.
+func (c *Cluster) newSession(node *Node) (*ssh.Session, error) {
+	sc := c.ssh.conn(node.ID)
+	dial := func() (*ssh.Client, error) { return c.dialSSH(node) }
+
+	for attempt := 0; ; attempt++ {
+		client, err := sc.get(dial)
+		if err != nil {
+			return nil, err
+		}
+		session, err := client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		sc.reset(client)
+		if attempt > 0 {
+			return nil, fmt.Errorf("failed to create SSH session: %w", err)
+		}
+	}
+}
+
+// RunCommand runs command on the node and returns its output and exit code.
+// The command is killed when ctx is done; without a deadline it gets
+// DefaultCommandTimeout.
+func (c *Cluster) RunCommand(ctx context.Context, nodeID, command string) (*CommandResult, error) {
+	node, err := c.Node(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return c.run(ctx, node, command, nil, nil)
+}
+
+// run runs command on the node over its pooled SSH connection, or through
+// the guest agent when SSH cannot be reached. The output is captured in the
+// result, logged line by line to the node command log and passed to
+// OnOutput, and also copied to stdout and stderr when they are not nil. A
+// non-zero exit status is returned as an error carrying the end of the
+// command output. Bootstrap tokens and certificate keys are redacted from
+// the log, OnOutput and the error, but not from the result.
+func (c *Cluster) run(ctx context.Context, node *Node, command string, stdout, stderr io.Writer) (*CommandResult, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCommandTimeout)
+		defer cancel()
+	}
+
+	result := &CommandResult{NodeID: node.ID, Command: command, ExitCode: -1}
+
+	logFile, err := os.OpenFile(filepath.Join(node.RootPath, commandLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return result, fmt.Errorf("failed to open command log: %v", err)
+	}
+	defer logFile.Close()
+	fmt.Fprintf(logFile, "%s $ %s\n", time.Now().Format(time.RFC3339), redactSecrets(command))
+
+	var outBuf, errBuf bytes.Buffer
+	outLines := c.lineWriter(node, "stdout", logFile)
+	errLines := c.lineWriter(node, "stderr", logFile)
+	outW := multiWriter(&outBuf, outLines, stdout)
+	errW := multiWriter(&errBuf, errLines, stderr)
+
+	start := time.Now()
+	code, err := c.execSSH(ctx, node, command, nil, outW, errW)
+	if errors.Is(err, errSSHUnreachable) && node.VsockPath != "" {
+		client := agent.NewClient(node.VsockPath, agent.DefaultPort)
+		if client.Ping(ctx) == nil {
+			fmt.Fprintf(logFile, "%s %v, running through the guest agent\n", time.Now().Format(time.RFC3339), err)
+			code, err = client.Exec(ctx, command, outW, errW)
+		}
+	}
+
+	outLines.flush()
+	errLines.flush()
+	result.Stdout = outBuf.String()
+	result.Stderr = errBuf.String()
+	result.Duration = time.Since(start)
+	result.ExitCode = code
+
+	switch {
+	case err == nil && code == 0:
+	case err == nil:
+		err = fmt.Errorf("command on %s exited with status %d:\n%s", node.ID, code, redactSecrets(outputTail(result, 20)))
+	case ctx.Err() != nil:
+		err = fmt.Errorf("command on %s did not finish: %w", node.ID, ctx.Err())
+	default:
+		err = fmt.Errorf("failed to execute command on %s: %w", node.ID, err)
+	}
+
+	fmt.Fprintf(logFile, "%s exit %d after %s\n", time.Now().Format(time.RFC3339), result.ExitCode, result.Duration.Round(time.Millisecond))
+	return result, err
+}
+
+// errSSHUnreachable marks failures to open an SSH session on a node
+var errSSHUnreachable = errors.New("SSH unreachable")
+
+// execSSH runs command in a session on the pooled connection of the node
+// and returns its exit status. The error is nil whenever the command exited,
+// whatever its status.
+func (c *Cluster) execSSH(ctx context.Context, node *Node, command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	session, err := c.newSession(node)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %v", errSSHUnreachable, err)
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return -1, fmt.Errorf("failed to start command: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		return -1, ctx.Err()
+	}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus(), nil
+	default:
+		return -1, err
+	}
+}
+
+// putFile writes data to path on the node, replacing the file atomically and
+// creating its directory, over SSH or through the guest agent when SSH
+// cannot be reached
+func (c *Cluster) putFile(ctx context.Context, node *Node, path string, data []byte, mode os.FileMode) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCommandTimeout)
+		defer cancel()
+	}
+
+	tmp := path + ".tmp"
+	command := fmt.Sprintf("mkdir -p %s && cat > %s && chmod %o %s && mv %s %s",
+		shellQuote(filepath.Dir(path)), shellQuote(tmp), mode.Perm(), shellQuote(tmp), shellQuote(tmp), shellQuote(path))
+
+	var stderr bytes.Buffer
+	code, err := c.execSSH(ctx, node, command, bytes.NewReader(data), io.Discard, &stderr)
+	if errors.Is(err, errSSHUnreachable) && node.VsockPath != "" {
+		client := agent.NewClient(node.VsockPath, agent.DefaultPort)
+		if client.Ping(ctx) == nil {
+			return client.PutFile(ctx, path, data, mode)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("writing %s exited with status %d: %s", path, code, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// getFile reads the file at path on the node, over SSH or through the guest
+// agent when SSH cannot be reached. Unlike run, nothing is logged, so it is
+// what reads credentials off the nodes.
+func (c *Cluster) getFile(ctx context.Context, node *Node, path string) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCommandTimeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := c.execSSH(ctx, node, "cat "+shellQuote(path), nil, &stdout, &stderr)
+	if errors.Is(err, errSSHUnreachable) && node.VsockPath != "" {
+		client := agent.NewClient(node.VsockPath, agent.DefaultPort)
+		if client.Ping(ctx) == nil {
+			return client.GetFile(ctx, path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("reading %s exited with status %d: %s", path, code, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// multiWriter is io.MultiWriter skipping nil writers
+func multiWriter(writers ...io.Writer) io.Writer {
+	var ws []io.Writer
+	for _, w := range writers {
+		if w != nil {
+			ws = append(ws, w)
+		}
+	}
+	return io.MultiWriter(ws...)
+}
+
+// outputTail returns the last n lines of the command error output, or of its
+// standard output if it wrote nothing to stderr
+func outputTail(result *CommandResult, n int) string {
+	out := strings.TrimRight(result.Stderr, "\n")
+	if out == "" {
+		out = strings.TrimRight(result.Stdout, "\n")
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Secrets kubeadm prints: bootstrap tokens, and the keys encrypting the
+// uploaded control plane certificates. Hashes of the CA certificate look
+// like keys but are public.
+var (
+	bootstrapTokenRe = regexp.MustCompile(`\b[a-z0-9]{6}\.[a-z0-9]{16}\b`)
+	certificateKeyRe = regexp.MustCompile(`(sha256:)?\b[0-9a-f]{64}\b`)
+)
+
+// redactSecrets hides the bootstrap tokens and certificate keys in s
+func redactSecrets(s string) string {
+	s = bootstrapTokenRe.ReplaceAllString(s, "[redacted]")
+	return certificateKeyRe.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "sha256:") {
+			return m
+		}
+		return "[redacted]"
+	})
+}
+
+// lineWriter splits a command output stream into lines for the node command
+// log and the OnOutput callback
+type lineWriter struct {
+	buf  []byte
+	emit func(line string)
+}
+
+func (c *Cluster) lineWriter(node *Node, stream string, logFile io.Writer) *lineWriter {
+	return &lineWriter{emit: func(line string) {
+		line = redactSecrets(line)
+		fmt.Fprintf(logFile, "%s [%s] %s\n", time.Now().Format(time.RFC3339), stream, line)
+		if c.OnOutput != nil {
+			c.OnOutput(node.ID, stream, line)
+		}
+	}}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush emits the last line if the output did not end with a newline
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
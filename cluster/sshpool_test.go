@@ -0,0 +1,56 @@
+package cluster
+
+import "testing"
+
+func TestRedactSecrets(t *testing.T) {
+	certKey := "f0e1d2c3b4a5968778695a4b3c2d1e0ff0e1d2c3b4a5968778695a4b3c2d1e0f"
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "join command",
+			in:   "kubeadm join 172.16.0.2:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash sha256:" + sha256Hex,
+			want: "kubeadm join 172.16.0.2:6443 --token [redacted] --discovery-token-ca-cert-hash sha256:" + sha256Hex,
+		},
+		{
+			name: "flag with equals sign",
+			in:   "--token=abcdef.0123456789abcdef",
+			want: "--token=[redacted]",
+		},
+		{
+			name: "certificate key",
+			in:   "kubeadm join 172.16.0.2:6443 --control-plane --certificate-key " + certKey,
+			want: "kubeadm join 172.16.0.2:6443 --control-plane --certificate-key [redacted]",
+		},
+		{
+			name: "uploaded certificates",
+			in:   "[upload-certs] Using certificate key:\n" + certKey + "\n",
+			want: "[upload-certs] Using certificate key:\n[redacted]\n",
+		},
+		{
+			name: "several tokens",
+			in:   `"aaaaaa.0123456789abcdef" "bbbbbb.0123456789abcdef"`,
+			want: `"[redacted]" "[redacted]"`,
+		},
+		{
+			name: "token IDs and short hex",
+			in:   "kubeadm token delete abcdef; sha " + sha256Hex[:40],
+			want: "kubeadm token delete abcdef; sha " + sha256Hex[:40],
+		},
+		{
+			name: "no secrets",
+			in:   "node dev-wk-0 joined the cluster",
+			want: "node dev-wk-0 joined the cluster",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactSecrets(tt.in); got != tt.want {
+				t.Errorf("redactSecrets(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
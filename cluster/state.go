@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// BaseDir is the directory under which every cluster keeps its node
+// directories and state file.
+const BaseDir = "./firecracker-k8s-cluster"
+
+const stateFileName = "state.json"
+
+// clusterState is the on-disk representation of a Cluster.
+type clusterState struct {
+	Config          ClusterConfig `json:"config"`
+	Nodes           []*Node       `json:"nodes"`
+	LoadBalancerPID int           `json:"loadBalancerPID,omitempty"` // API server load balancer of an HA control plane
+	UpdatedAt       time.Time     `json:"updatedAt"`
+}
+
+// clusterDir returns the working directory of the named cluster
+func clusterDir(name string) string {
+	return filepath.Join(BaseDir, name)
+}
+
+// statePath returns the path of the state file of the named cluster
+func statePath(name string) string {
+	return filepath.Join(clusterDir(name), stateFileName)
+}
+
+// SaveState writes the cluster configuration and node list to the state file
+// so the cluster can be reattached with Load from another process.
+func (c *Cluster) SaveState() error {
+	if err := os.MkdirAll(clusterDir(c.Config.Name), 0755); err != nil {
+		return fmt.Errorf("failed to create cluster directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(clusterState{
+		Config:          c.Config,
+		Nodes:           c.Nodes,
+		LoadBalancerPID: c.lbPID,
+		UpdatedAt:       time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cluster state: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn state file
+	path := statePath(c.Config.Name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cluster state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write cluster state: %v", err)
+	}
+
+	return nil
+}
+
+// List returns the names of all clusters that have a state file
+func List() ([]string, error) {
+	entries, err := os.ReadDir(BaseDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", BaseDir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(statePath(entry.Name())); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// removeState deletes the state file of the cluster
+func (c *Cluster) removeState() error {
+	if err := os.Remove(statePath(c.Config.Name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Load reads the state file of the named cluster and reattaches to the
+// Firecracker processes that are still running. Nodes whose process or API
+// socket is gone are marked dead.
+func Load(name string) (*Cluster, error) {
+	state, err := readState(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewCluster(state.Config)
+	c.Nodes = state.Nodes
+	c.lbPID = state.LoadBalancerPID
+	for _, node := range c.Nodes {
+		c.reattachNode(node)
+	}
+
+	return c, nil
+}
+
+// readState reads the state file of the named cluster
+func readState(name string) (*clusterState, error) {
+	data, err := os.ReadFile(statePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("cluster %s not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster state: %v", err)
+	}
+
+	var state clusterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode cluster state %s: %v", statePath(name), err)
+	}
+	return &state, nil
+}
+
+// reattachNode connects a Machine handle to the running Firecracker process
+// of the node, or marks the node dead if the process is gone.
+func (c *Cluster) reattachNode(node *Node) {
+	if node.Status != NodeRunning {
+		return
+	}
+
+	if !c.vmmAlive(node.ID)(node.PID) {
+		node.Status = NodeDead
+		return
+	}
+
+	if _, err := os.Stat(node.SocketPath); err != nil {
+		node.Status = NodeDead
+		return
+	}
+
+	m, err := firecracker.NewMachine(c.ctx, firecracker.Config{
+		SocketPath: node.SocketPath,
+		VMID:       node.ID,
+	})
+	if err != nil {
+		node.Status = NodeDead
+		return
+	}
+
+	// Make sure the API socket actually answers before trusting it
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := m.DescribeInstanceInfo(ctx); err != nil {
+		node.Status = NodeDead
+		return
+	}
+
+	node.Machine = m
+}
+
+// firecrackerBinary is the Firecracker executable unjailed nodes run,
+// looked up in PATH
+const firecrackerBinary = "firecracker"
+
+// vmmAlive returns a check of whether a PID belongs to the running VMM of
+// the node: Firecracker, or the jailer about to become it
+func (c *Cluster) vmmAlive(nodeID string) func(pid int) bool {
+	binaries := []string{firecrackerBinary}
+	if j := c.Config.Jailer; j != nil {
+		binaries = []string{filepath.Base(j.FirecrackerBinary), filepath.Base(j.JailerBinary)}
+	}
+	return func(pid int) bool {
+		return firecrackerAlive(pid, nodeID, binaries...)
+	}
+}
+
+// firecrackerAlive reports whether pid belongs to a running process of one
+// of the binaries, given --id id unless id is empty. The command line is
+// checked so a recycled PID, or another process of this tool whose command
+// line mentions Firecracker, is not mistaken for the node's VMM.
+func firecrackerAlive(pid int, id string, binaries ...string) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	return isVMMCommandLine(strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00"), id, binaries)
+}
+
+// isVMMCommandLine reports whether argv runs one of the binaries, given
+// --id id unless id is empty
+func isVMMCommandLine(argv []string, id string, binaries []string) bool {
+	if len(argv) == 0 || !slices.Contains(binaries, filepath.Base(argv[0])) {
+		return false
+	}
+	if id == "" {
+		return true
+	}
+	for i, arg := range argv[1:] {
+		if arg == "--" {
+			break
+		}
+		if arg == "--id="+id || arg == "--id" && i+2 < len(argv) && argv[i+2] == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestIsVMMCommandLine(t *testing.T) {
+	binaries := []string{"firecracker-v1.9.0", "jailer-v1.9.0"}
+	tests := []struct {
+		name string
+		argv []string
+		want bool
+	}{
+		{"firecracker", []string{"firecracker-v1.9.0", "--api-sock", "/run/api.sock", "--id", "dev-wk-0"}, true},
+		{"jailed firecracker", []string{"/firecracker-v1.9.0", "--id", "dev-wk-0", "--start-time-us", "1"}, true},
+		{"jailer", []string{"./setup/bin/jailer-v1.9.0", "--id", "dev-wk-0", "--exec-file", "/setup/bin/firecracker-v1.9.0", "--", "--api-sock", "api.sock"}, true},
+		{"id with equals sign", []string{"firecracker-v1.9.0", "--id=dev-wk-0"}, true},
+		{"other node", []string{"firecracker-v1.9.0", "--id", "dev-wk-1"}, false},
+		{"node with a longer ID", []string{"firecracker-v1.9.0", "--id", "dev-wk-01"}, false},
+		{"no id", []string{"firecracker-v1.9.0", "--api-sock", "/run/api.sock"}, false},
+		{"id as the value of another flag", []string{"firecracker-v1.9.0", "--api-sock", "--id"}, false},
+		{"id after --", []string{"jailer-v1.9.0", "--", "--id", "dev-wk-0"}, false},
+		{"command line interface", []string{"./firecracker-k8s", "console-relay", "--id", "dev-wk-0"}, false},
+		{"load balancer", []string{"/usr/local/bin/firecracker-k8s", "api-lb", "-listen", "172.16.0.1:6443"}, false},
+		{"firecracker in an argument", []string{"vim", "firecracker-v1.9.0", "--id", "dev-wk-0"}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isVMMCommandLine(tt.argv, "dev-wk-0", binaries); got != tt.want {
+				t.Errorf("isVMMCommandLine(%q) = %v, want %v", tt.argv, got, tt.want)
+			}
+		})
+	}
+
+	if !isVMMCommandLine([]string{"firecracker", "--api-sock", "api.sock"}, "", []string{"firecracker"}) {
+		t.Error("process without --id rejected when no ID is required")
+	}
+}
+
+func TestFirecrackerAlive(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("no shell: %v", err)
+	}
+	// A shell standing in for Firecracker. The trailing command keeps it
+	// from replacing itself with sleep.
+	cmd := &exec.Cmd{Path: sh, Args: []string{"firecracker", "-c", "sleep 30; :", "--id", "dev-wk-0"}}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	if !firecrackerAlive(pid, "dev-wk-0", "firecracker") {
+		t.Error("running VMM of dev-wk-0 not found")
+	}
+	if firecrackerAlive(pid, "dev-wk-1", "firecracker") {
+		t.Error("VMM of dev-wk-0 taken for that of dev-wk-1")
+	}
+	if firecrackerAlive(pid, "dev-wk-0", "jailer") {
+		t.Error("VMM taken for a jailer")
+	}
+	if firecrackerAlive(os.Getpid(), "", "firecracker") {
+		t.Error("test process taken for a VMM")
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	if firecrackerAlive(pid, "dev-wk-0", "firecracker") {
+		t.Error("VMM reported alive after it exited")
+	}
+}
@@ -0,0 +1,47 @@
+// Command fck8s-agent is the guest agent of firecracker-k8s nodes. It
+// listens on a vsock port and serves the requests of the agent package, so
+// the host can reach the node without IP networking.
+//
+// Build it statically and set agentBinary in the cluster spec to have it
+// installed on every node:
+//
+//	CGO_ENABLED=0 go build -o ./setup/bin/fck8s-agent ./cmd/fck8s-agent
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"firecracker-k8s/agent"
+)
+
+func main() {
+	port := flag.Uint("port", agent.DefaultPort, "vsock port to listen on")
+	flag.Parse()
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		log.Fatalf("Failed to create vsock socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: uint32(*port)}); err != nil {
+		log.Fatalf("Failed to bind vsock port %d: %v", *port, err)
+	}
+	if err := unix.Listen(fd, 16); err != nil {
+		log.Fatalf("Failed to listen on vsock port %d: %v", *port, err)
+	}
+	log.Printf("Listening on vsock port %d", *port)
+
+	for {
+		conn, _, err := unix.Accept4(fd, unix.SOCK_CLOEXEC)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ECONNABORTED {
+				continue
+			}
+			log.Fatalf("Failed to accept connection: %v", err)
+		}
+		go agent.ServeConn(os.NewFile(uintptr(conn), "vsock"))
+	}
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"firecracker-k8s/cluster"
+	"firecracker-k8s/console"
+)
+
+// newFlagSet returns a flag set for the named subcommand whose usage
+// message shows the command's synopsis
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(fs.Output(), "Usage: %s %s\n", os.Args[0], cmd.usage)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a subcommand and checks that exactly n
+// positional arguments follow them
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return nil, fmt.Errorf("expected %d argument(s), got %d", n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+func runCreate(args []string) error {
+	fs := newFlagSet("create")
+	name := fs.String("name", "", "Cluster name")
+	nodes := fs.Int("nodes", 3, "Number of nodes")
+	masters := fs.Int("masters", 1, "Number of control plane nodes out of -nodes: 1, 3 or 5")
+	memory := fs.Int64("memory", 1024, "Memory per node in MB")
+	vcpu := fs.Int64("vcpu", 1, "VCPUs per node")
+	rootfs := fs.String("rootfs", "", "Path to root filesystem image")
+	persistent := fs.Bool("persistent", false, "Enable persistent storage")
+	subnet := fs.String("subnet", "172.16.0.0/24", "Node subnet CIDR")
+	gateway := fs.String("gateway", "172.16.0.1", "Gateway IP")
+	kernel := fs.String("kernel", "", "Path to uncompressed kernel image (default "+cluster.DefaultKernelPath+")")
+	initrd := fs.String("initrd", "", "Path to an initial ramdisk")
+	bootArgs := fs.String("boot-args", "", "Kernel command line template; {{.IP}}, {{.Gateway}}, {{.Netmask}} and {{.Hostname}} are replaced per node")
+	sshUser := fs.String("ssh-user", "", "Account of the root image nodes are reached as over SSH (default "+cluster.DefaultSSHUser+")")
+	podCIDR := fs.String("pod-cidr", cluster.DefaultPodCIDR, "Pod network CIDR")
+	serviceCIDR := fs.String("service-cidr", cluster.DefaultServiceCIDR, "Service network CIDR")
+	dnsDomain := fs.String("dns-domain", cluster.DefaultDNSDomain, "DNS domain of the cluster services")
+	cni := fs.String("cni", cluster.CNIFlannel, "Pod network plugin: calico, cilium, flannel or none")
+	cniManifest := fs.String("cni-manifest", "", "Local CNI manifest; required for calico and cilium")
+	k8sVersion := fs.String("kubernetes-version", "", "Kubernetes release to install, e.g. v1.31.2 (default: the kubeadm version of the nodes)")
+	var certSANs stringList
+	fs.Var(&certSANs, "cert-san", "Extra name of the API server certificate; can be repeated")
+	jailed := fs.Bool("jailed", false, "Launch nodes through the Firecracker jailer")
+	verify := fs.Bool("verify", true, "Check the health of the cluster once it is set up")
+	specFile := fs.String("f", "", "Cluster spec file (YAML or JSON); replaces the other cluster flags")
+	output := fs.String("o", "table", "Output format: table or json")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	// Create cluster configuration
+	var config cluster.ClusterConfig
+	if *specFile != "" {
+		var err error
+		if config, err = cluster.LoadSpec(*specFile); err != nil {
+			return err
+		}
+	} else {
+		// Validate required flags
+		if *name == "" || *rootfs == "" {
+			return errors.New("cluster name and root filesystem path are required")
+		}
+
+		config = cluster.ClusterConfig{
+			Name:       *name,
+			NodeCount:  *nodes,
+			Masters:    *masters,
+			MemSizeMB:  *memory,
+			VCPUCount:  *vcpu,
+			RootDrive:  *rootfs,
+			KernelPath: *kernel,
+			InitrdPath: *initrd,
+			BootArgs:   *bootArgs,
+			SSHUser:    *sshUser,
+			Persistent: *persistent,
+			NetworkConfig: cluster.Network{
+				SubnetCIDR:  *subnet,
+				Gateway:     *gateway,
+				PodCIDR:     *podCIDR,
+				ServiceCIDR: *serviceCIDR,
+				DNSDomain:   *dnsDomain,
+			},
+			CNI: cluster.CNIConfig{
+				Plugin:   *cni,
+				Manifest: *cniManifest,
+			},
+			Kubernetes: cluster.KubernetesConfig{
+				Version:  *k8sVersion,
+				CertSANs: certSANs,
+			},
+		}
+		if *jailed {
+			config.Jailer = &cluster.JailerConfig{}
+		}
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := cluster.Load(config.Name); err == nil {
+		return fmt.Errorf("cluster %s already exists; boot it again with %s start %s", config.Name, os.Args[0], config.Name)
+	}
+
+	// Create new cluster instance
+	c := cluster.NewCluster(config)
+
+	// An interrupt cancels provisioning, which then rolls back whatever it
+	// started before returning
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		if _, ok := <-sigChan; ok {
+			log.Println("Interrupted, rolling back cluster...")
+			c.Cancel()
+		}
+	}()
+
+	// Provision the cluster
+	log.Printf("Provisioning cluster '%s' with %d nodes...", config.Name, config.TotalNodes())
+	if err := c.Provision(); err != nil {
+		return fmt.Errorf("failed to provision cluster: %v", err)
+	}
+
+	// The cluster is kept from here on, even when it turns out unhealthy
+	signal.Stop(sigChan)
+
+	var health *cluster.HealthReport
+	if *verify {
+		log.Printf("Verifying cluster '%s'...", config.Name)
+		var err error
+		if health, err = c.VerifyHealth(context.Background()); err != nil {
+			return fmt.Errorf("failed to verify cluster: %v", err)
+		}
+	}
+
+	if err := printCluster(os.Stdout, *output, c, health); err != nil {
+		return err
+	}
+	if health != nil && !health.Healthy() {
+		return fmt.Errorf("cluster %s is not healthy, see 'check %s'", config.Name, config.Name)
+	}
+	if *output == "table" {
+		fmt.Println("\nCluster is ready!")
+		fmt.Printf("Manage it with: kubectl --kubeconfig=%s get nodes\n", c.KubeconfigPath())
+	}
+	return nil
+}
+
+func runList(args []string) error {
+	fs := newFlagSet("list")
+	output := fs.String("o", "table", "Output format: table or json")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	names, err := cluster.List()
+	if err != nil {
+		return err
+	}
+
+	clusters := make([]*cluster.Cluster, 0, len(names))
+	for _, name := range names {
+		c, err := cluster.Load(name)
+		if err != nil {
+			log.Printf("Skipping cluster %s: %v", name, err)
+			continue
+		}
+		clusters = append(clusters, c)
+	}
+
+	return printClusters(os.Stdout, *output, clusters)
+}
+
+func runStatus(args []string) error {
+	fs := newFlagSet("status")
+	output := fs.String("o", "table", "Output format: table or json")
+	consoleLines := fs.Int("console", 5, "Recent serial console lines shown per node")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := printCluster(os.Stdout, *output, c, nil); err != nil {
+		return err
+	}
+	if *consoleLines <= 0 || *output != "table" {
+		return nil
+	}
+	return printConsoles(os.Stdout, c, *consoleLines)
+}
+
+func runCheck(args []string) error {
+	fs := newFlagSet("check")
+	output := fs.String("o", "table", "Output format: table or json")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	report, err := c.VerifyHealth(context.Background())
+	if err != nil {
+		return err
+	}
+	switch *output {
+	case "json":
+		err = printJSON(os.Stdout, report)
+	case "table":
+		err = printHealth(os.Stdout, report)
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !report.Healthy() {
+		return fmt.Errorf("cluster %s is not healthy", c.Config.Name)
+	}
+	return nil
+}
+
+func runDelete(args []string) error {
+	pos, err := parseArgs(newFlagSet("delete"), args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.Delete(); err != nil {
+		return err
+	}
+	log.Printf("Cluster %s deleted", c.Config.Name)
+	return nil
+}
+
+func runStop(args []string) error {
+	fs := newFlagSet("stop")
+	drain := fs.Bool("drain", false, "Drain workers in Kubernetes before shutting them down")
+	gracePeriod := fs.Duration("grace-period", 0, "Time the guests get to power off before SIGTERM (default from the cluster config, 30s)")
+	killTimeout := fs.Duration("kill-timeout", 0, "Time the VMMs get to exit on SIGTERM before SIGKILL (default from the cluster config, 10s)")
+	output := fs.String("o", "table", "Output format: table or json")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	cfg := c.Config.Shutdown
+	cfg.Drain = cfg.Drain || *drain
+	if *gracePeriod > 0 {
+		cfg.GracePeriod = cluster.Duration(*gracePeriod)
+	}
+	if *killTimeout > 0 {
+		cfg.KillTimeout = cluster.Duration(*killTimeout)
+	}
+
+	report, err := c.Stop(cfg)
+	if err != nil {
+		return err
+	}
+	switch *output {
+	case "json":
+		err = printJSON(os.Stdout, report)
+	case "table":
+		err = printShutdown(os.Stdout, report)
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !report.Clean() {
+		return fmt.Errorf("some nodes of cluster %s did not shut down cleanly", c.Config.Name)
+	}
+	log.Printf("Cluster %s stopped", c.Config.Name)
+	return nil
+}
+
+func runStart(args []string) error {
+	pos, err := parseArgs(newFlagSet("start"), args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+	log.Printf("Cluster %s started", c.Config.Name)
+	return nil
+}
+
+func runSSH(args []string) error {
+	pos, err := parseArgs(newFlagSet("ssh"), args, 2)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+	node, err := c.Node(pos[1])
+	if err != nil {
+		return err
+	}
+
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		return err
+	}
+
+	// Replace this process so ssh owns the terminal. The host key was pinned
+	// when the cluster was provisioned, so a different key is refused.
+	argv := []string{"ssh",
+		"-i", c.SSHKeyPath(),
+		"-o", "IdentitiesOnly=yes",
+		"-o", "UserKnownHostsFile=" + c.KnownHostsPath(),
+		"-o", "StrictHostKeyChecking=yes",
+		fmt.Sprintf("%s@%s", node.Username, node.IP),
+	}
+	return syscall.Exec(sshPath, argv, os.Environ())
+}
+
+func runExec(args []string) error {
+	fs := newFlagSet("exec")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 3 {
+		fs.Usage()
+		return fmt.Errorf("expected a cluster, a node and a command")
+	}
+
+	c, err := cluster.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	result, err := c.Exec(fs.Arg(1), strings.Join(fs.Args()[2:], " "), os.Stdout, os.Stderr)
+	if result != nil && result.ExitCode > 0 {
+		// The output has been shown already, pass the status on
+		os.Exit(result.ExitCode)
+	}
+	return err
+}
+
+func runLogs(args []string) error {
+	fs := newFlagSet("logs")
+	console := fs.Bool("console", false, "Print the serial console instead of the Firecracker log")
+	sshLog := fs.Bool("ssh", false, "Print the log of commands run on the node over SSH")
+	follow := fs.Bool("f", false, "Keep printing new log lines")
+	pos, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	node, err := loadNode(pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(node.RootPath, "firecracker.log")
+	switch {
+	case *console:
+		path = filepath.Join(node.RootPath, "console.log")
+	case *sshLog:
+		path = filepath.Join(node.RootPath, "ssh.log")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	for {
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			return err
+		}
+		if !*follow {
+			return nil
+		}
+		time.Sleep(time.Second)
+
+		// The console relay rotates its log by renaming it; finish the old
+		// file and go on with the new one
+		current, err := os.Stat(path)
+		if err != nil {
+			continue // not created again yet
+		}
+		open, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(open, current) {
+			continue
+		}
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			return err
+		}
+		f.Close()
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+	}
+}
+
+func runMetadata(args []string) error {
+	fs := newFlagSet("metadata")
+	schema := fs.Bool("schema", false, "Print the JSON schema of the metadata document")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *schema {
+		fmt.Print(cluster.MetadataSchema)
+		return nil
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a cluster and a node")
+	}
+
+	c, err := cluster.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	md, err := c.Metadata(context.Background(), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, md)
+}
+
+func runAddWorkers(args []string) error {
+	fs := newFlagSet("add-workers")
+	count := fs.Int("n", 1, "Number of workers to add")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Adding %d worker(s) to cluster %s...", *count, c.Config.Name)
+	nodes, err := c.AddWorkers(*count)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		log.Printf("Node %s joined at %s", node.ID, node.IP)
+	}
+	return nil
+}
+
+func runRemoveWorker(args []string) error {
+	pos, err := parseArgs(newFlagSet("remove-worker"), args, 2)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Draining and removing node %s...", pos[1])
+	if err := c.RemoveWorker(pos[1]); err != nil {
+		return err
+	}
+	log.Printf("Node %s removed from cluster %s", pos[1], c.Config.Name)
+	return nil
+}
+
+func runSnapshot(args []string) error {
+	fs := newFlagSet("snapshot")
+	list := fs.Bool("list", false, "List the snapshots of the cluster")
+	output := fs.String("o", "table", "Output format of -list: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *list {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return fmt.Errorf("expected a cluster")
+		}
+		c, err := cluster.Load(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		snapshots, err := c.Snapshots()
+		if err != nil {
+			return err
+		}
+		return printSnapshots(os.Stdout, *output, snapshots)
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a cluster and a snapshot name")
+	}
+
+	c, err := cluster.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Snapshotting cluster %s...", c.Config.Name)
+	if _, err := c.Snapshot(fs.Arg(1)); err != nil {
+		return err
+	}
+	log.Printf("Snapshot %s of cluster %s created", fs.Arg(1), c.Config.Name)
+	return nil
+}
+
+func runRestore(args []string) error {
+	pos, err := parseArgs(newFlagSet("restore"), args, 2)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restoring cluster %s to snapshot %s...", c.Config.Name, pos[1])
+	if err := c.Restore(pos[1]); err != nil {
+		return err
+	}
+	log.Printf("Cluster %s restored to snapshot %s", c.Config.Name, pos[1])
+	return nil
+}
+
+func runKubeconfig(args []string) error {
+	fs := newFlagSet("kubeconfig")
+	path := fs.Bool("path", false, "Print the path of the kubeconfig instead of its contents")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	if *path {
+		fmt.Println(c.KubeconfigPath())
+		return nil
+	}
+	data, err := os.ReadFile(c.KubeconfigPath())
+	if err != nil {
+		return fmt.Errorf("failed to read kubeconfig: %v", err)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runRotateToken(args []string) error {
+	pos, err := parseArgs(newFlagSet("rotate-token"), args, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.RotateJoinToken(context.Background()); err != nil {
+		return err
+	}
+	log.Printf("Published a new join command to the workers of cluster %s", c.Config.Name)
+	return nil
+}
+
+// detachKey ends an attach session (Ctrl-])
+const detachKey = 0x1d
+
+func runAttach(args []string) error {
+	pos, err := parseArgs(newFlagSet("attach"), args, 2)
+	if err != nil {
+		return err
+	}
+
+	c, err := cluster.Load(pos[0])
+	if err != nil {
+		return err
+	}
+
+	// Pass keys through untouched; the guest does its own echo and editing
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+	}
+
+	fmt.Fprintf(os.Stderr, "Connected to the console of %s, press Ctrl-] to detach\r\n", pos[1])
+	err = c.AttachConsole(context.Background(), pos[1], &detachReader{r: os.Stdin}, os.Stdout)
+	fmt.Fprintf(os.Stderr, "\r\nDetached from %s\r\n", pos[1])
+	return err
+}
+
+// detachReader reads from r until the detach key is typed. Input before the
+// key in the same read is passed on first.
+type detachReader struct {
+	r        io.Reader
+	detached bool
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	if d.detached {
+		return 0, io.EOF
+	}
+	n, err := d.r.Read(p)
+	if i := bytes.IndexByte(p[:n], detachKey); i >= 0 {
+		d.detached = true
+		if i == 0 {
+			return 0, io.EOF
+		}
+		return i, nil
+	}
+	return n, err
+}
+
+// runConsoleRelay is the hidden command relaying the serial console of a
+// node, started by the cluster package for every node it boots
+func runConsoleRelay(args []string) error {
+	fs := flag.NewFlagSet(cluster.ConsoleRelayCommand, flag.ExitOnError)
+	var cfg console.RelayConfig
+	fs.StringVar(&cfg.LogPath, "log", "", "Console log file")
+	fs.StringVar(&cfg.SocketPath, "socket", "", "Socket to serve the console on")
+	fs.Int64Var(&cfg.LogSize, "log-size", console.DefaultLogSize, "Size at which the log is rotated")
+	fs.IntVar(&cfg.LogFiles, "log-files", console.DefaultLogFiles, "Rotated logs kept")
+	fs.IntVar(&cfg.BufferSize, "buffer", console.DefaultBufferSize, "Bytes of recent output kept in memory")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	// The relay runs until the VMM exits, whatever happens to its parent
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT)
+	return cluster.RunConsoleRelay(cfg)
+}
+
+// runLoadBalancer is the hidden command balancing the API server port of an
+// HA control plane, started by the cluster package
+func runLoadBalancer(args []string) error {
+	fs := flag.NewFlagSet(cluster.LoadBalancerCommand, flag.ExitOnError)
+	listen := fs.String("listen", "", "Address to accept API server connections on")
+	var backends stringList
+	fs.Var(&backends, "backend", "API server address; repeat for every control plane node")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	signal.Ignore(syscall.SIGHUP)
+	return cluster.RunLoadBalancer(ctx, *listen, backends)
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// loadNode loads the named cluster and returns one of its nodes
+func loadNode(clusterName, nodeID string) (*cluster.Node, error) {
+	c, err := cluster.Load(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	return c.Node(nodeID)
+}
@@ -0,0 +1,128 @@
+// Package console captures the serial console of a node and lets clients
+// attach to it.
+//
+// A node's VMM runs with the slave side of a pseudo-terminal as its standard
+// input and output, which Firecracker connects to the guest ttyS0. A relay
+// process holding the master side copies everything the guest prints into a
+// rotating log file and an in-memory ring buffer, and serves a Unix socket.
+// The relay lives as long as the VMM: it exits once the VMM has closed the
+// terminal.
+//
+// A client connecting to the socket sends one request line. "tail\n" returns
+// the ring buffer and closes the connection. "attach\n" returns the ring
+// buffer followed by the live console output, and everything the client
+// writes is typed on the console.
+package console
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Requests sent on the relay socket
+const (
+	RequestTail   = "tail"
+	RequestAttach = "attach"
+)
+
+// Defaults of the relay settings
+const (
+	DefaultLogSize    = 10 << 20 // bytes written to a log file before it is rotated
+	DefaultLogFiles   = 3        // rotated log files kept besides the current one
+	DefaultBufferSize = 64 << 10 // bytes of recent output kept in memory
+)
+
+// Ring keeps the last bytes written to it
+type Ring struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+// NewRing returns a ring buffer keeping the last size bytes
+func NewRing(size int) *Ring {
+	return &Ring{size: size}
+}
+
+func (r *Ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+	if over := len(r.buf) - r.size; over > 0 {
+		r.buf = append(r.buf[:0], r.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the buffered output
+func (r *Ring) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.buf...)
+}
+
+// LogFile is a log file rotated once it reaches its maximum size. Rotated
+// files get the suffixes .1, .2 and so on, .1 being the most recent.
+type LogFile struct {
+	path    string
+	maxSize int64
+	files   int
+	f       *os.File
+	size    int64
+}
+
+// OpenLog rotates any existing log at path, so every boot starts a new file,
+// and opens a new one
+func OpenLog(path string, maxSize int64, files int) (*LogFile, error) {
+	l := &LogFile{path: path, maxSize: maxSize, files: files}
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		l.shift()
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open console log: %v", err)
+	}
+	l.f = f
+	l.size = 0
+	return nil
+}
+
+// shift renames the current log to .1, .1 to .2 and so on, dropping the
+// oldest
+func (l *LogFile) shift() {
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.files))
+	for i := l.files - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.files > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	if l.size+int64(len(p)) > l.maxSize && l.size > 0 {
+		l.f.Close()
+		l.shift()
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *LogFile) Close() error {
+	return l.f.Close()
+}
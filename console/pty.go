@@ -0,0 +1,41 @@
+package console
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// OpenPTY opens a new pseudo-terminal and returns its master and slave
+// sides. The slave is in raw mode: the guest echoes and edits lines itself.
+func OpenPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pseudo-terminal: %v", err)
+	}
+	fail := func(err error) (*os.File, *os.File, error) {
+		master.Close()
+		return nil, nil, err
+	}
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		return fail(fmt.Errorf("failed to unlock pseudo-terminal: %v", err))
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		return fail(fmt.Errorf("failed to get pseudo-terminal number: %v", err))
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open pseudo-terminal slave: %v", err))
+	}
+	if _, err := term.MakeRaw(int(slave.Fd())); err != nil {
+		slave.Close()
+		return fail(fmt.Errorf("failed to set pseudo-terminal to raw mode: %v", err))
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,222 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// clientBacklog is the number of output chunks queued for an attached
+// client before it is disconnected for reading too slowly
+const clientBacklog = 256
+
+// RelayConfig describes where a relay keeps the console output
+type RelayConfig struct {
+	LogPath    string
+	SocketPath string
+	LogSize    int64 // DefaultLogSize if zero
+	LogFiles   int   // rotated log files kept
+	BufferSize int   // DefaultBufferSize if zero
+}
+
+// relay copies the output of a pseudo-terminal master to the log, the ring
+// buffer and the attached clients
+type relay struct {
+	master *os.File
+	ring   *Ring
+
+	mu      sync.Mutex
+	clients map[chan []byte]net.Conn
+}
+
+// Serve relays the console behind master until the slave side is closed by
+// every process holding it
+func Serve(master *os.File, cfg RelayConfig) error {
+	if cfg.LogSize <= 0 {
+		cfg.LogSize = DefaultLogSize
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+
+	logFile, err := OpenLog(cfg.LogPath, cfg.LogSize, cfg.LogFiles)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	os.Remove(cfg.SocketPath)
+	ln, err := net.Listen("unix", cfg.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", cfg.SocketPath, err)
+	}
+	defer os.Remove(cfg.SocketPath)
+	defer ln.Close()
+
+	r := &relay{
+		master:  master,
+		ring:    NewRing(cfg.BufferSize),
+		clients: make(map[chan []byte]net.Conn),
+	}
+	go r.accept(ln)
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := master.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			logFile.Write(chunk)
+			r.broadcast(chunk)
+		}
+		if err != nil {
+			r.closeClients()
+			// EIO means the last slave descriptor was closed: the VMM is gone
+			if err == io.EOF || errors.Is(err, syscall.EIO) {
+				return nil
+			}
+			return fmt.Errorf("failed to read console: %v", err)
+		}
+	}
+}
+
+func (r *relay) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.serveConn(conn)
+	}
+}
+
+// broadcast records a chunk of output and queues it for the attached clients
+func (r *relay) broadcast(chunk []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ring.Write(chunk)
+	for out, conn := range r.clients {
+		select {
+		case out <- chunk:
+		default:
+			delete(r.clients, out)
+			close(out)
+			conn.Close()
+		}
+	}
+}
+
+func (r *relay) closeClients() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for out := range r.clients {
+		delete(r.clients, out)
+		close(out)
+	}
+}
+
+func (r *relay) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	switch strings.TrimSpace(line) {
+	case RequestTail:
+		conn.Write(r.ring.Bytes())
+
+	case RequestAttach:
+		// Register under the lock so no output falls between the replayed
+		// buffer and the live stream
+		out := make(chan []byte, clientBacklog)
+		r.mu.Lock()
+		backlog := r.ring.Bytes()
+		r.clients[out] = conn
+		r.mu.Unlock()
+
+		go func() {
+			conn.Write(backlog)
+			for chunk := range out {
+				if _, err := conn.Write(chunk); err != nil {
+					return
+				}
+			}
+			conn.Close()
+		}()
+
+		io.Copy(r.master, br)
+
+		r.mu.Lock()
+		if _, ok := r.clients[out]; ok {
+			delete(r.clients, out)
+			close(out)
+		}
+		r.mu.Unlock()
+
+	default:
+		fmt.Fprintf(conn, "unknown request %q\n", strings.TrimSpace(line))
+	}
+}
+
+// Tail returns the recent console output buffered by the relay listening
+// on socketPath
+func Tail(ctx context.Context, socketPath string) ([]byte, error) {
+	conn, err := dial(ctx, socketPath, RequestTail)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return io.ReadAll(conn)
+}
+
+// Attach connects in and out to the console served on socketPath. Output
+// starts with the buffered recent output. It returns when in reaches EOF,
+// the relay goes away or ctx is done.
+func Attach(ctx context.Context, socketPath string, in io.Reader, out io.Writer) error {
+	conn, err := dial(ctx, socketPath, RequestAttach)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, in)
+		conn.Close()
+	}()
+	_, err = io.Copy(out, conn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// dial connects to the relay and sends the request. The connection is
+// closed when ctx is done.
+func dial(ctx context.Context, socketPath, request string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to console: %w", err)
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	if _, err := fmt.Fprintf(conn, "%s\n", request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send console request: %v", err)
+	}
+	return conn, nil
+}
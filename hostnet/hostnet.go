@@ -0,0 +1,290 @@
+// Package hostnet configures the host side of cluster networking through
+// netlink and nftables: a bridge carrying the gateway address, one TAP device
+// per node attached to the bridge, IP forwarding, and masquerading of traffic
+// that leaves the node subnet. Nodes that run in a network namespace of their
+// own reach the bridge through a veth pair.
+//
+// Every operation is idempotent, so setup can be rerun after a partial
+// failure and teardown can be run on resources that are already gone.
+package hostnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Host applies network configuration to one network namespace
+type Host struct {
+	nl  *netlink.Handle
+	nft *nftables.Conn
+	ns  netns.NsHandle // -1 for the namespace of the calling process
+
+	ownsNS bool // ns was opened by the Host and is closed with it
+}
+
+// New returns a Host operating on the network namespace of the process
+func New() (*Host, error) {
+	nl, err := netlink.NewHandle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink handle: %v", err)
+	}
+
+	nft, err := nftables.New()
+	if err != nil {
+		nl.Close()
+		return nil, fmt.Errorf("failed to open nftables connection: %v", err)
+	}
+
+	return &Host{nl: nl, nft: nft, ns: -1}, nil
+}
+
+// NewInNamespace returns a Host operating on the network namespace ns, such
+// as a throwaway namespace created with netns.New for testing
+func NewInNamespace(ns netns.NsHandle) (*Host, error) {
+	nl, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink handle: %v", err)
+	}
+
+	nft, err := nftables.New(nftables.WithNetNSFd(int(ns)))
+	if err != nil {
+		nl.Close()
+		return nil, fmt.Errorf("failed to open nftables connection: %v", err)
+	}
+
+	return &Host{nl: nl, nft: nft, ns: ns}, nil
+}
+
+// Close releases the netlink handles
+func (h *Host) Close() {
+	h.nl.Close()
+	if h.ownsNS {
+		h.ns.Close()
+	}
+}
+
+// EnsureBridge creates the bridge if it does not exist, assigns it the
+// gateway address, if any, and brings it up
+func (h *Host) EnsureBridge(name string, gateway *net.IPNet) error {
+	link, err := h.nl.LinkByName(name)
+	if err != nil {
+		if !isNotFound(err) {
+			return fmt.Errorf("failed to look up bridge %s: %v", name, err)
+		}
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err := h.nl.LinkAdd(bridge); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %v", name, err)
+		}
+		if link, err = h.nl.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to look up bridge %s: %v", name, err)
+		}
+	}
+
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return fmt.Errorf("link %s exists but is a %s, not a bridge", name, link.Type())
+	}
+
+	if gateway != nil {
+		addr := &netlink.Addr{IPNet: gateway}
+		if err := h.nl.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("failed to assign %s to bridge %s: %v", gateway, name, err)
+		}
+	}
+
+	if err := h.nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up bridge %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// TapOptions controls how a TAP device is created
+type TapOptions struct {
+	// Owner and Group may open the device, letting an unprivileged or
+	// jailed Firecracker process use it
+	Owner uint32
+	Group uint32
+
+	// Queues above 1 create a multi-queue device. Firecracker opens its TAP
+	// devices single-queue, so leave this at 0 for Firecracker nodes.
+	Queues int
+
+	// Bridge, if set, is the bridge the device is attached to
+	Bridge string
+}
+
+// EnsureTap creates the persistent TAP device if it does not exist, attaches
+// it to the bridge and brings it up
+func (h *Host) EnsureTap(name string, opts TapOptions) error {
+	link, err := h.nl.LinkByName(name)
+	if err != nil {
+		if !isNotFound(err) {
+			return fmt.Errorf("failed to look up TAP device %s: %v", name, err)
+		}
+
+		// Firecracker attaches to its TAP device with TUNSETIFF, asking for
+		// IFF_TAP, IFF_NO_PI and IFF_VNET_HDR. The ioctl fails if the device is
+		// a TUN device or differs in IFF_MULTI_QUEUE, and otherwise replaces
+		// the remaining flags with those of the caller, so create the device
+		// with the same flags to leave nothing to change
+		flags := netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR
+		if opts.Queues > 1 {
+			flags |= netlink.TUNTAP_MULTI_QUEUE
+		}
+
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     flags,
+			Queues:    opts.Queues,
+			Owner:     opts.Owner,
+			Group:     opts.Group,
+		}
+		if err := h.inNamespace(func() error { return h.nl.LinkAdd(tap) }); err != nil {
+			return fmt.Errorf("failed to create TAP device %s: %v", name, err)
+		}
+		for _, fd := range tap.Fds {
+			fd.Close()
+		}
+
+		if link, err = h.nl.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to look up TAP device %s: %v", name, err)
+		}
+	}
+
+	return h.attach(link, opts.Bridge)
+}
+
+// AttachToBridge attaches an existing link to the bridge and brings it up
+func (h *Host) AttachToBridge(name, bridge string) error {
+	link, err := h.nl.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %v", name, err)
+	}
+	return h.attach(link, bridge)
+}
+
+// attach makes bridge, if set, the master of link and brings link up
+func (h *Host) attach(link netlink.Link, bridge string) error {
+	name := link.Attrs().Name
+	if bridge != "" {
+		master, err := h.nl.LinkByName(bridge)
+		if err != nil {
+			return fmt.Errorf("failed to look up bridge %s: %v", bridge, err)
+		}
+		if link.Attrs().MasterIndex != master.Attrs().Index {
+			if err := h.nl.LinkSetMaster(link, master); err != nil {
+				return fmt.Errorf("failed to attach %s to bridge %s: %v", name, bridge, err)
+			}
+		}
+	}
+
+	if err := h.nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// DeleteLink removes a TAP device or bridge. A link that does not exist is
+// not an error.
+func (h *Host) DeleteLink(name string) error {
+	link, err := h.nl.LinkByName(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up %s: %v", name, err)
+	}
+
+	if err := h.nl.LinkDel(link); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete %s: %v", name, err)
+	}
+	return nil
+}
+
+// EnableForwarding turns on IP forwarding for the family of subnet
+func (h *Host) EnableForwarding(subnet *net.IPNet) error {
+	path := "/proc/sys/net/ipv4/ip_forward"
+	if subnet.IP.To4() == nil {
+		path = "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+
+	// /proc/sys/net shows the namespace of the thread that opens it
+	return h.inNamespace(func() error {
+		if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+		return nil
+	})
+}
+
+// Route is a route of the main routing table
+type Route struct {
+	Dst  *net.IPNet
+	Link string // Name of the outgoing interface, empty if it has none
+}
+
+// Routes lists the routes of the main table that have a destination, leaving
+// out default routes
+func (h *Host) Routes() ([]Route, error) {
+	list, err := h.nl.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: syscall.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	var routes []Route
+	for _, r := range list {
+		if r.Dst == nil {
+			continue
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		route := Route{Dst: r.Dst}
+		if link, err := h.nl.LinkByIndex(r.LinkIndex); err == nil {
+			route.Link = link.Attrs().Name
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// inNamespace runs fn on a thread switched into the namespace of the Host.
+// Some operations, such as opening /dev/net/tun or /proc/sys/net, act on the
+// namespace of the calling thread rather than on a netlink handle.
+func (h *Host) inNamespace(fn func() error) error {
+	if h.ns == -1 {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer orig.Close()
+
+	if err := netns.Set(h.ns); err != nil {
+		return fmt.Errorf("failed to enter network namespace: %v", err)
+	}
+	defer netns.Set(orig)
+
+	return fn()
+}
+
+// isNotFound reports whether err means the link does not exist
+func isNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, syscall.ENODEV)
+}
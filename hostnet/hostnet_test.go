@@ -0,0 +1,163 @@
+package hostnet
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// testHost returns a Host operating on a throwaway network namespace, along
+// with a netlink handle to inspect it. The namespace goes away with the last
+// handle on it when the test ends.
+func testHost(t *testing.T) (*Host, *netlink.Handle) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+
+	// netns.New switches the calling thread into the new namespace, so do it
+	// on a locked thread and switch back before unlocking it
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("failed to get current network namespace: %v", err)
+	}
+	ns, err := netns.New()
+	if serr := netns.Set(orig); serr != nil {
+		// Leave the thread locked so it exits with the test goroutine
+		t.Fatalf("failed to leave network namespace: %v", serr)
+	}
+	orig.Close()
+	runtime.UnlockOSThread()
+	if err != nil {
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	h, err := NewInNamespace(ns)
+	if err != nil {
+		t.Fatalf("NewInNamespace: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	nl, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatalf("failed to open netlink handle: %v", err)
+	}
+	t.Cleanup(nl.Close)
+
+	return h, nl
+}
+
+func TestLinksAreIdempotent(t *testing.T) {
+	h, nl := testHost(t)
+
+	_, subnet, _ := net.ParseCIDR("172.30.0.0/24")
+	gateway := &net.IPNet{IP: net.ParseIP("172.30.0.1").To4(), Mask: subnet.Mask}
+
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("TAP devices are not available: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.EnsureBridge("br-test", gateway); err != nil {
+			t.Fatalf("EnsureBridge #%d: %v", i+1, err)
+		}
+		if err := h.EnsureTap("tap-test", TapOptions{Bridge: "br-test"}); err != nil {
+			t.Fatalf("EnsureTap #%d: %v", i+1, err)
+		}
+	}
+
+	bridge, err := nl.LinkByName("br-test")
+	if err != nil {
+		t.Fatalf("bridge not found: %v", err)
+	}
+	if _, ok := bridge.(*netlink.Bridge); !ok {
+		t.Errorf("br-test is a %s, want a bridge", bridge.Type())
+	}
+	if bridge.Attrs().Flags&net.FlagUp == 0 {
+		t.Error("bridge is not up")
+	}
+	addrs, err := nl.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("failed to list bridge addresses: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].IPNet.String() != gateway.String() {
+		t.Errorf("bridge addresses = %v, want only %s", addrs, gateway)
+	}
+
+	tap, err := nl.LinkByName("tap-test")
+	if err != nil {
+		t.Fatalf("TAP device not found: %v", err)
+	}
+	if tap.Attrs().MasterIndex != bridge.Attrs().Index {
+		t.Errorf("TAP device master = %d, want bridge %d", tap.Attrs().MasterIndex, bridge.Attrs().Index)
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"tap-test", "br-test"} {
+			if err := h.DeleteLink(name); err != nil {
+				t.Fatalf("DeleteLink(%s) #%d: %v", name, i+1, err)
+			}
+		}
+	}
+	for _, name := range []string{"tap-test", "br-test"} {
+		if _, err := nl.LinkByName(name); !isNotFound(err) {
+			t.Errorf("%s still exists after DeleteLink: %v", name, err)
+		}
+	}
+}
+
+func TestMasqueradeIsIdempotent(t *testing.T) {
+	h, _ := testHost(t)
+
+	_, subnet, _ := net.ParseCIDR("172.30.0.0/24")
+	for i := 0; i < 2; i++ {
+		if err := h.EnsureMasquerade("hostnet-test", subnet); err != nil {
+			t.Fatalf("EnsureMasquerade #%d: %v", i+1, err)
+		}
+	}
+
+	table := &nftables.Table{Name: "hostnet-test", Family: nftables.TableFamilyIPv4}
+	chains, err := h.nft.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to list chains: %v", err)
+	}
+	var chain *nftables.Chain
+	for _, c := range chains {
+		if c.Table.Name == table.Name && c.Name == "postrouting" {
+			chain = c
+		}
+	}
+	if chain == nil {
+		t.Fatal("postrouting chain not found")
+	}
+	rules, err := h.nft.GetRules(table, chain)
+	if err != nil {
+		t.Fatalf("failed to list rules: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Errorf("got %d rules after two calls, want 1", len(rules))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.DeleteMasquerade("hostnet-test"); err != nil {
+			t.Fatalf("DeleteMasquerade #%d: %v", i+1, err)
+		}
+	}
+	tables, err := h.nft.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to list tables: %v", err)
+	}
+	for _, tbl := range tables {
+		if tbl.Name == table.Name {
+			t.Error("table still exists after DeleteMasquerade")
+		}
+	}
+}
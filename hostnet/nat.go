@@ -0,0 +1,87 @@
+package hostnet
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// EnsureMasquerade installs an nftables table named table with a NAT rule
+// masquerading traffic from subnet to any destination outside it. The table
+// is rebuilt from scratch, so calling it again leaves exactly one rule.
+func (h *Host) EnsureMasquerade(table string, subnet *net.IPNet) error {
+	family, saddrOffset, daddrOffset, addrLen := nftables.TableFamilyIPv4, uint32(12), uint32(16), uint32(4)
+	ip := subnet.IP.To4()
+	if ip == nil {
+		family, saddrOffset, daddrOffset, addrLen = nftables.TableFamilyIPv6, 8, 24, 16
+		ip = subnet.IP.To16()
+	}
+	mask := []byte(subnet.Mask)
+	if len(mask) != len(ip) {
+		return fmt.Errorf("subnet %s has a mask of the wrong length", subnet)
+	}
+
+	if err := h.deleteTable(table, family); err != nil {
+		return err
+	}
+
+	t := h.nft.AddTable(&nftables.Table{Name: table, Family: family})
+	chain := h.nft.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    t,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	// <family> saddr <subnet> <family> daddr != <subnet> masquerade
+	h.nft.AddRule(&nftables.Rule{
+		Table: t,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: saddrOffset, Len: addrLen},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: addrLen, Mask: mask, Xor: make([]byte, addrLen)},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: daddrOffset, Len: addrLen},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: addrLen, Mask: mask, Xor: make([]byte, addrLen)},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ip},
+			&expr.Masq{},
+		},
+	})
+
+	if err := h.nft.Flush(); err != nil {
+		return fmt.Errorf("failed to install masquerade rule for %s: %v", subnet, err)
+	}
+	return nil
+}
+
+// DeleteMasquerade removes the table installed by EnsureMasquerade from both
+// address families. A missing table is not an error.
+func (h *Host) DeleteMasquerade(table string) error {
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		if err := h.deleteTable(table, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTable removes the named table of family if it exists
+func (h *Host) deleteTable(name string, family nftables.TableFamily) error {
+	tables, err := h.nft.ListTablesOfFamily(family)
+	if err != nil {
+		return fmt.Errorf("failed to list nftables tables: %v", err)
+	}
+
+	for _, t := range tables {
+		if t.Name == name {
+			h.nft.DelTable(t)
+			if err := h.nft.Flush(); err != nil {
+				return fmt.Errorf("failed to delete nftables table %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
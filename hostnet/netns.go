@@ -0,0 +1,111 @@
+package hostnet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// namespaceDir is where named network namespaces are bind-mounted, the same
+// place `ip netns` uses
+const namespaceDir = "/var/run/netns"
+
+// NamespacePath returns the path of the named network namespace
+func NamespacePath(name string) string {
+	return filepath.Join(namespaceDir, name)
+}
+
+// EnsureNamespace creates the named network namespace if it does not exist
+func EnsureNamespace(name string) error {
+	if _, err := os.Stat(NamespacePath(name)); err == nil {
+		return nil
+	}
+
+	// NewNamed switches the calling thread into the new namespace, so do it
+	// on a locked thread and switch back before unlocking it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer orig.Close()
+
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		netns.Set(orig)
+		return fmt.Errorf("failed to create network namespace %s: %v", name, err)
+	}
+	ns.Close()
+
+	if err := netns.Set(orig); err != nil {
+		return fmt.Errorf("failed to leave network namespace %s: %v", name, err)
+	}
+	return nil
+}
+
+// OpenNamespace returns a Host operating on the named network namespace
+func OpenNamespace(name string) (*Host, error) {
+	ns, err := netns.GetFromName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace %s: %v", name, err)
+	}
+
+	h, err := NewInNamespace(ns)
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	h.ownsNS = true
+	return h, nil
+}
+
+// DeleteNamespace removes the named network namespace. The links inside it
+// go away with it. A namespace that does not exist is not an error.
+func DeleteNamespace(name string) error {
+	if _, err := os.Stat(NamespacePath(name)); os.IsNotExist(err) {
+		return nil
+	}
+	if err := netns.DeleteNamed(name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete network namespace %s: %v", name, err)
+	}
+	return nil
+}
+
+// EnsureVeth creates a veth pair if it does not exist, with the end called
+// name attached to bridge and the end called peer moved into the named
+// network namespace
+func (h *Host) EnsureVeth(name, bridge, peer, namespace string) error {
+	link, err := h.nl.LinkByName(name)
+	if err != nil {
+		if !isNotFound(err) {
+			return fmt.Errorf("failed to look up veth %s: %v", name, err)
+		}
+
+		ns, err := netns.GetFromName(namespace)
+		if err != nil {
+			return fmt.Errorf("failed to open network namespace %s: %v", namespace, err)
+		}
+		defer ns.Close()
+
+		veth := &netlink.Veth{
+			LinkAttrs:     netlink.LinkAttrs{Name: name},
+			PeerName:      peer,
+			PeerNamespace: netlink.NsFd(ns),
+		}
+		if err := h.nl.LinkAdd(veth); err != nil {
+			return fmt.Errorf("failed to create veth %s: %v", name, err)
+		}
+
+		if link, err = h.nl.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to look up veth %s: %v", name, err)
+		}
+	}
+
+	return h.attach(link, bridge)
+}
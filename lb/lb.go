@@ -0,0 +1,159 @@
+// Package lb is the TCP load balancer the host runs in front of the API
+// servers of a cluster with several control-plane nodes. Connections are
+// spread round-robin over the backends that pass their health check, a TCP
+// connect made every HealthInterval.
+package lb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthInterval is the time between two health checks of a backend
+const HealthInterval = 2 * time.Second
+
+// dialTimeout bounds health checks and connections to a backend
+const dialTimeout = 2 * time.Second
+
+type backend struct {
+	addr    string
+	healthy atomic.Bool
+}
+
+// Balancer forwards the connections it accepts to its backends
+type Balancer struct {
+	backends []*backend
+	next     atomic.Uint32
+	logger   *log.Logger
+}
+
+// New returns a balancer for the backends, given as host:port
+func New(backends []string, logger *log.Logger) *Balancer {
+	b := &Balancer{logger: logger}
+	for _, addr := range backends {
+		b.backends = append(b.backends, &backend{addr: addr})
+	}
+	return b
+}
+
+// Serve accepts connections on listen and forwards them until ctx is done
+func (b *Balancer) Serve(ctx context.Context, listen string) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", listen)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() { ln.Close() })
+	b.logger.Printf("Listening on %s", listen)
+
+	for _, be := range b.backends {
+		go b.check(ctx, be)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.forward(ctx, conn)
+		}()
+	}
+}
+
+// check keeps the health of the backend up to date
+func (b *Balancer) check(ctx context.Context, be *backend) {
+	for {
+		conn, err := net.DialTimeout("tcp", be.addr, dialTimeout)
+		healthy := err == nil
+		if healthy {
+			conn.Close()
+		}
+		if be.healthy.Swap(healthy) != healthy {
+			if healthy {
+				b.logger.Printf("Backend %s is up", be.addr)
+			} else {
+				b.logger.Printf("Backend %s is down: %v", be.addr, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(HealthInterval):
+		}
+	}
+}
+
+// candidates returns the backends to try for a connection, healthy ones
+// first in round-robin order. Unhealthy backends are still tried last, so
+// the first API server is reachable before its first health check passes.
+func (b *Balancer) candidates() []*backend {
+	start := int(b.next.Add(1))
+	var healthy, unhealthy []*backend
+	for i := range b.backends {
+		be := b.backends[(start+i)%len(b.backends)]
+		if be.healthy.Load() {
+			healthy = append(healthy, be)
+		} else {
+			unhealthy = append(unhealthy, be)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// forward connects the client to the first backend that accepts and copies
+// data both ways until either side closes
+func (b *Balancer) forward(ctx context.Context, client net.Conn) {
+	defer client.Close()
+
+	var upstream net.Conn
+	for _, be := range b.candidates() {
+		d := net.Dialer{Timeout: dialTimeout}
+		conn, err := d.DialContext(ctx, "tcp", be.addr)
+		if err == nil {
+			upstream = conn
+			break
+		}
+		be.healthy.Store(false)
+	}
+	if upstream == nil {
+		b.logger.Printf("No backend available for %s", client.RemoteAddr())
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+
+	select {
+	case <-done:
+		<-done
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,113 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// startBackend listens on a free port and greets every connection with its
+// name. Closing the returned listener kills the backend.
+func startBackend(t *testing.T, name string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+// startBalancer serves the backends on a free port and returns its address
+func startBalancer(t *testing.T, backends ...string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- New(backends, log.New(io.Discard, "", 0)).Serve(ctx, addr)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("balancer not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// greeting connects through the balancer and returns what the backend sent
+func greeting(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial balancer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read through balancer: %v", err)
+	}
+	return string(data)
+}
+
+func TestFailover(t *testing.T) {
+	a := startBackend(t, "a")
+	b := startBackend(t, "b")
+	addr := startBalancer(t, a.Addr().String(), b.Addr().String())
+
+	seen := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		seen[greeting(t, addr)]++
+	}
+	if seen["a"] == 0 || seen["b"] == 0 {
+		t.Errorf("connections reached %v, want both backends", seen)
+	}
+
+	// Connections fail over to b before the next health check notices a
+	// is gone
+	a.Close()
+	for i := 0; i < 10; i++ {
+		if got := greeting(t, addr); got != "b" {
+			t.Fatalf("connection %d after a went down reached %q, want b", i, got)
+		}
+	}
+
+	// With no backend left, clients are disconnected
+	b.Close()
+	if got := greeting(t, addr); got != "" {
+		t.Errorf("connection without backends reached %q", got)
+	}
+}
@@ -1,190 +1,92 @@
-// package main
-
-// import (
-// 	"context"
-// 	// "io"
-// 	"log"
-
-// 	// "path/filepath"
-
-// 	"github.com/firecracker-microvm/firecracker-go-sdk"
-// 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
-// )
-
-// func main() {
-// 	ctx := context.Background()
-
-// 	// Configuration for multiple VMs
-// 	vms := []struct {
-// 		VMID       string
-// 		SocketPath string
-// 		KernelPath string
-// 		RootFSPath string
-// 	}{
-// 		{"vm1", "/tmp/firecracker-vm1.sock", "./setup/vmlinux-5.10.225", "./setup/ubuntu-24.04.ext4"},
-// 		{"vm2", "/tmp/firecracker-vm2.sock", "./setup/vmlinux-5.10.225", "./setup/ubuntu-24.04.ext4"},
-// 	}
-
-// 	// Launch all VMs
-// 	for _, vm := range vms {
-// 		go func(vmConfig struct {
-// 			VMID       string
-// 			SocketPath string
-// 			KernelPath string
-// 			RootFSPath string
-// 		}) {
-// 			err := launchFirecrackerInstance(ctx, vmConfig.VMID, vmConfig.SocketPath, vmConfig.KernelPath, vmConfig.RootFSPath)
-// 			if err != nil {
-// 				log.Printf("Failed to start VM %s: %v", vmConfig.VMID, err)
-// 			}
-// 		}(vm)
-// 	}
-
-// 	// Keep the main thread alive
-// 	select {}
-// }
-
-// func launchFirecrackerInstance(ctx context.Context, vmID string, socketPath string, kernelPath string, rootFSPath string) error {
-// 	var vcpuCount int64 = 1
-// 	var memSizeMib int64 = 512
-// 	smt := false
-
-// 	driveID := "rootfs"
-// 	isRootDevice := true
-// 	isReadOnly := false
-// 	pathOnHost := rootFSPath // "./setup-microvm/ubuntu-24.04.ext4" // "./setup-microvm/root-drive-with-ssh.img"
-
-// 	cfg := firecracker.Config{
-// 		SocketPath: socketPath,
-// 		MachineCfg: models.MachineConfiguration{
-// 			VcpuCount:  &vcpuCount,
-// 			MemSizeMib: &memSizeMib,
-// 			Smt:        &smt,
-// 		},
-// 		Drives: []models.Drive{
-// 			{
-// 				DriveID:      &driveID,
-// 				IsRootDevice: &isRootDevice,
-// 				IsReadOnly:   &isReadOnly,
-// 				PathOnHost:   &pathOnHost,
-// 			},
-// 		},
-// 		KernelImagePath: kernelPath,
-// 	}
-
-// 	// cmdBuilderOpts := firecracker.VMCommandBuilder{
-// 	// 	bin:        "./setup/vmlinux-5.10.225",
-// 	// 	args:       []string{},
-// 	// 	socketPath: "",
-// 	// 	stdin:      io.Reader,
-// 	// 	stdout:     io.Writer,
-// 	// 	stderr:     io.Writer,
-// 	// }
-
-// 	// Create the Firecracker command
-// 	cmdBuilderOpts := firecracker.VMCommandBuilder{}
-// 	cmd := firecracker.VMCommandBuilder(cmdBuilderOpts).
-// 		WithSocketPath(socketPath).
-// 		Build(ctx)
-
-// 	// Start the Firecracker process
-// 	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithProcessRunner(cmd))
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	// Start the VM
-// 	if err := machine.Start(ctx); err != nil {
-// 		return err
-// 	}
-
-// 	log.Printf("Firecracker VM %s started successfully.", vmID)
-// 	return nil
-// }
-
 package main
 
 import (
-	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
 
 	"firecracker-k8s/cluster"
 )
 
-func main() {
-	// Parse command line flags
-	name := flag.String("name", "", "Cluster name")
-	nodes := flag.Int("nodes", 3, "Number of nodes")
-	memory := flag.Int64("memory", 1024, "Memory per node in MB")
-	vcpu := flag.Int64("vcpu", 1, "VCPUs per node")
-	rootfs := flag.String("rootfs", "", "Path to root filesystem image")
-	persistent := flag.Bool("persistent", false, "Enable persistent storage")
-	subnet := flag.String("subnet", "172.16.0.0/24", "Subnet CIDR")
-	gateway := flag.String("gateway", "172.16.0.1", "Gateway IP")
-	flag.Parse()
+// command is a CLI subcommand operating on named clusters
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
 
-	// Validate required flags
-	if *name == "" || *rootfs == "" {
-		log.Fatal("Cluster name and root filesystem path are required")
+// commands is filled in by init because the subcommands look themselves up
+// in it to print their usage
+var commands []command
+
+func init() {
+	commands = []command{
+		{"create", "create (-f <spec> | -name <cluster> -rootfs <image>) [flags]", "Provision a new cluster", runCreate},
+		{"list", "list [-o table|json]", "List clusters", runList},
+		{"status", "status [-o table|json] [-console n] <cluster>", "Show the nodes of a cluster", runStatus},
+		{"check", "check [-o table|json] <cluster>", "Check that the nodes are Ready and cluster DNS and networking work", runCheck},
+		{"delete", "delete <cluster>", "Shut down a cluster and remove its disks", runDelete},
+		{"stop", "stop [-drain] [-grace-period d] [-kill-timeout d] [-o table|json] <cluster>", "Shut down the nodes of a cluster, keeping their disks", runStop},
+		{"start", "start <cluster>", "Boot the nodes of a stopped cluster from their disks and wait until they are Ready", runStart},
+		{"snapshot", "snapshot (-list [-o table|json] <cluster> | <cluster> <name>)", "Snapshot the memory and disks of every node of a running cluster, or list the snapshots", runSnapshot},
+		{"restore", "restore <cluster> <name>", "Bring every node of a cluster back to a snapshot", runRestore},
+		{"add-workers", "add-workers [-n count] <cluster>", "Boot new workers and join them to a running cluster", runAddWorkers},
+		{"remove-worker", "remove-worker <cluster> <node>", "Drain a worker, delete it from Kubernetes and remove its VM", runRemoveWorker},
+		{"ssh", "ssh <cluster> <node>", "Open an interactive SSH session on a node", runSSH},
+		{"exec", "exec <cluster> <node> <command...>", "Run a command on a node", runExec},
+		{"logs", "logs [-console | -ssh] [-f] <cluster> <node>", "Print the Firecracker, console or SSH command log of a node", runLogs},
+		{"attach", "attach <cluster> <node>", "Attach the terminal to the serial console of a node", runAttach},
+		{"metadata", "metadata (-schema | <cluster> <node>)", "Print the MMDS metadata of a node or its schema", runMetadata},
+		{"kubeconfig", "kubeconfig [-path] <cluster>", "Print the admin kubeconfig of a cluster, usable from the host", runKubeconfig},
+		{"rotate-token", "rotate-token <cluster>", "Create a new join token and publish it to the workers", runRotateToken},
 	}
+}
 
-	// Create cluster configuration
-	config := cluster.ClusterConfig{
-		Name:       *name,
-		NodeCount:  *nodes,
-		MemSizeMB:  *memory,
-		VCPUCount:  *vcpu,
-		RootDrive:  *rootfs,
-		Persistent: *persistent,
-		NetworkConfig: cluster.Network{
-			SubnetCIDR: *subnet,
-			Gateway:    *gateway,
-		},
-	}
+func main() {
+	log.SetFlags(0)
 
-	// Create new cluster instance
-	c := cluster.NewCluster(config)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
 
-	// Setup graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		log.Println("Shutting down cluster...")
-		c.Cleanup()
-		os.Exit(0)
-	}()
+	name, args := os.Args[1], os.Args[2:]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return
+	}
 
-	// Provision the cluster
-	log.Printf("Provisioning cluster '%s' with %d nodes...", config.Name, config.NodeCount)
-	if err := c.Provision(); err != nil {
-		log.Fatalf("Failed to provision cluster: %v", err)
+	// Not listed in commands: started by the cluster package, not by users
+	hidden := map[string]func([]string) error{
+		cluster.ConsoleRelayCommand: runConsoleRelay,
+		cluster.LoadBalancerCommand: runLoadBalancer,
+	}
+	if run, ok := hidden[name]; ok {
+		if err := run(args); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		return
 	}
 
-	// Print cluster information
-	printClusterInfo(c)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(args); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
+		}
+	}
 
-	// Keep the program running
-	select {}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
 }
 
-func printClusterInfo(c *cluster.Cluster) {
-	fmt.Println("\nCluster Information:")
-	fmt.Printf("Name: %s\n", c.Config.Name)
-	fmt.Printf("Nodes: %d\n", len(c.Nodes))
-	fmt.Println("\nNode Details:")
-	
-	for _, node := range c.Nodes {
-		fmt.Printf("\nID: %s\n", node.ID)
-		fmt.Printf("Role: %s\n", node.Role)
-		fmt.Printf("IP: %s\n", node.IP)
-		fmt.Printf("Socket: %s\n", node.Machine.Cfg.SocketPath)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.summary)
 	}
-
-	fmt.Println("\nCluster is ready!")
-	fmt.Println("Use 'kubectl' on the master node to manage the cluster")
-}
\ No newline at end of file
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
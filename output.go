@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"firecracker-k8s/cluster"
+)
+
+// clusterSummary is the list view of a cluster
+type clusterSummary struct {
+	Name       string `json:"name"`
+	Nodes      int    `json:"nodes"`
+	Running    int    `json:"running"`
+	Persistent bool   `json:"persistent"`
+	Subnet     string `json:"subnet"`
+}
+
+// clusterDetail is the status view of a cluster
+type clusterDetail struct {
+	Config cluster.ClusterConfig `json:"config"`
+	Nodes  []*cluster.Node       `json:"nodes"`
+	Health *cluster.HealthReport `json:"health,omitempty"`
+}
+
+func summarize(c *cluster.Cluster) clusterSummary {
+	s := clusterSummary{
+		Name:       c.Config.Name,
+		Nodes:      len(c.Nodes),
+		Persistent: c.Config.Persistent,
+		Subnet:     c.Config.NetworkConfig.SubnetCIDR,
+	}
+	for _, node := range c.Nodes {
+		if node.Status == cluster.NodeRunning {
+			s.Running++
+		}
+	}
+	return s
+}
+
+func printClusters(w io.Writer, format string, clusters []*cluster.Cluster) error {
+	summaries := make([]clusterSummary, 0, len(clusters))
+	for _, c := range clusters {
+		summaries = append(summaries, summarize(c))
+	}
+
+	switch format {
+	case "json":
+		return printJSON(w, summaries)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tNODES\tRUNNING\tPERSISTENT\tSUBNET")
+		for _, s := range summaries {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%t\t%s\n", s.Name, s.Nodes, s.Running, s.Persistent, s.Subnet)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// printCluster shows the nodes of the cluster and, when it is not nil, the
+// outcome of its health checks
+func printCluster(w io.Writer, format string, c *cluster.Cluster, health *cluster.HealthReport) error {
+	switch format {
+	case "json":
+		return printJSON(w, clusterDetail{Config: c.Config, Nodes: c.Nodes, Health: health})
+	case "table":
+		fmt.Fprintf(w, "Cluster: %s\n\n", c.Config.Name)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tROLE\tIP\tMAC\tSTATUS\tPID\tTAP\tSOCKET")
+		for _, node := range c.Nodes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				node.ID, node.Role, node.IP, node.MacAddress, node.Status, node.PID, node.TapName, node.SocketPath)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := printTimelines(w, c.Nodes); err != nil {
+			return err
+		}
+		if health != nil {
+			return printHealth(w, health)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// printTimelines lists the readiness stages each node went through on its
+// last boot, with the time since the boot started
+func printTimelines(w io.Writer, nodes []*cluster.Node) error {
+	fmt.Fprintf(w, "\nBoot timeline:\n\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tSTAGE\tAT\tTOOK\tRESULT")
+	for _, node := range nodes {
+		if len(node.Timeline) == 0 {
+			continue
+		}
+		boot := node.Timeline[0].Start
+		for _, event := range node.Timeline {
+			result := "ok"
+			if event.Error != "" {
+				result = event.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t+%s\t%s\t%s\n", node.ID, event.Stage,
+				event.Start.Sub(boot).Round(time.Millisecond), event.Duration.Round(time.Millisecond), result)
+		}
+	}
+	return tw.Flush()
+}
+
+// printHealth lists the outcome of each health check
+func printHealth(w io.Writer, report *cluster.HealthReport) error {
+	fmt.Fprintf(w, "\nHealth checks:\n\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tTOOK\tDETAILS")
+	for _, check := range report.Checks {
+		result := "pass"
+		switch {
+		case check.Skipped:
+			result = "skip"
+		case !check.Passed:
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", check.Name, result, check.Duration.Round(time.Millisecond), check.Message)
+	}
+	return tw.Flush()
+}
+
+// printShutdown lists how each node was shut down
+func printShutdown(w io.Writer, report *cluster.ShutdownReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tDRAINED\tSTOPPED BY\tTOOK\tERROR")
+	for _, n := range report.Nodes {
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\n", n.Node, n.Drained, n.StoppedBy, n.Duration.Round(time.Millisecond), n.Error)
+	}
+	return tw.Flush()
+}
+
+// printSnapshots lists the snapshots of a cluster
+func printSnapshots(w io.Writer, format string, snapshots []*cluster.SnapshotManifest) error {
+	switch format {
+	case "json":
+		if snapshots == nil {
+			snapshots = []*cluster.SnapshotManifest{}
+		}
+		return printJSON(w, snapshots)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATED\tNODES")
+		for _, s := range snapshots {
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", s.Name, s.CreatedAt.Local().Format(time.RFC3339), len(s.Nodes))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// printConsoles shows the last lines each node printed on its serial
+// console
+func printConsoles(w io.Writer, c *cluster.Cluster, lines int) error {
+	for _, node := range c.Nodes {
+		tail, err := c.ConsoleTail(context.Background(), node.ID, lines)
+		if err != nil || len(tail) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nConsole of %s:\n", node.ID)
+		for _, line := range tail {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return nil
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
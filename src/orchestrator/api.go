@@ -8,6 +8,7 @@ import (
     "os/exec"
     "sync"
 
+    "firecracker-k8s/cluster"
     "github.com/gin-gonic/gin"
 )
 
@@ -53,6 +54,8 @@ func createInstance(c *gin.Context) {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start Firecracker instance"})
         return
     }
+    // Reap the process whenever it exits
+    go cmd.Wait()
 
     instance := &FirecrackerInstance{
         ID:          id,
@@ -94,8 +97,12 @@ func stopInstance(c *gin.Context) {
         return
     }
 
-    if err := instance.Process.Process.Kill(); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop instance"})
+    // Shut the VM down the way cluster nodes are: Ctrl+Alt+Del, then
+    // SIGTERM and SIGKILL. Instances are not Kubernetes nodes, so there is
+    // nothing to drain.
+    stoppedBy, err := cluster.StopVMM(instance.Process.Process.Pid, instance.SocketPath, cluster.ShutdownConfig{})
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to stop instance: %v", err)})
         return
     }
 
@@ -103,5 +110,5 @@ func stopInstance(c *gin.Context) {
     delete(instances, id)
     mu.Unlock()
 
-    c.JSON(http.StatusOK, gin.H{"message": "Instance stopped"})
+    c.JSON(http.StatusOK, gin.H{"message": "Instance stopped", "stoppedBy": stoppedBy})
 }
\ No newline at end of file